@@ -1,15 +1,57 @@
 package backlog
 
 import (
+	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
+	"net/http"
 	"net/url"
+	"path"
+	"strings"
+	"sync"
 	"time"
 
 	backlog "github.com/griffin-stewie/go-backlog"
 	"github.com/lufia/taskfs/fs"
 )
 
+var states = map[string]backlog.IssueStatus{
+	fs.StateOpen:   backlog.Open,
+	"in-progress":  backlog.InProgress,
+	"resolved":     backlog.Resolved,
+	fs.StateClosed: backlog.Closed,
+}
+
+// issueComment is a comment of the issue. backlog.Comment lacks timestamps.
+type issueComment struct {
+	ID      int       `json:"id"`
+	Content *string   `json:"content"`
+	Created time.Time `json:"created"`
+	Updated time.Time `json:"updated"`
+}
+
+type Comment struct {
+	num     int
+	comment *issueComment
+}
+
+func (p *Comment) Key() string {
+	return fmt.Sprintf("%d", p.num)
+}
+
+func (p *Comment) Message() string {
+	return *p.comment.Content
+}
+
+func (p *Comment) Creation() time.Time {
+	return p.comment.Created
+}
+
+func (p *Comment) LastMod() time.Time {
+	return p.comment.Updated
+}
+
 type Issue struct {
 	issue *backlog.Issue
 	svc   *Service
@@ -19,6 +61,17 @@ func (p *Issue) Key() string {
 	return *p.issue.IssueKey
 }
 
+// Path returns the project key and the number of the issue.
+// Issue keys of Backlog are formatted as "PROJECT-123".
+func (p *Issue) Path() []string {
+	key := *p.issue.IssueKey
+	i := strings.LastIndexByte(key, '-')
+	if i < 0 {
+		return []string{key}
+	}
+	return []string{key[:i], key[i+1:]}
+}
+
 func (p *Issue) Subject() string {
 	return *p.issue.Summary
 }
@@ -31,6 +84,142 @@ func (p *Issue) PermaLink() string {
 	return fmt.Sprintf("https://%s/view/%s", p.svc.name, *p.issue.IssueKey)
 }
 
+// State returns the name of the issue status; one of open, in-progress,
+// resolved or closed.
+func (p *Issue) State() string {
+	for name, st := range states {
+		if p.issue.Status.ID != nil && int(st) == *p.issue.Status.ID {
+			return name
+		}
+	}
+	if p.issue.Status.Name != nil {
+		return *p.issue.Status.Name
+	}
+	return ""
+}
+
+// Labels returns the categories of the issue.
+func (p *Issue) Labels() []string {
+	a := make([]string, 0, len(p.issue.Category))
+	for _, c := range p.issue.Category {
+		if c.Name != nil {
+			a = append(a, *c.Name)
+		}
+	}
+	return a
+}
+
+// Assignees returns the user ID of the assignee. Backlog issues have
+// at most one assignee.
+func (p *Issue) Assignees() []string {
+	if p.issue.Assignee.UserID == nil {
+		return nil
+	}
+	return []string{*p.issue.Assignee.UserID}
+}
+
+func (p *Issue) Author() string {
+	if u := p.issue.CreatedUser; u != nil && u.UserID != nil {
+		return *u.UserID
+	}
+	return ""
+}
+
+// Milestone returns comma separated names of the milestones.
+func (p *Issue) Milestone() string {
+	a := make([]string, 0, len(p.issue.Milestone))
+	for _, v := range p.issue.Milestone {
+		if v.Name != nil {
+			a = append(a, *v.Name)
+		}
+	}
+	return strings.Join(a, ", ")
+}
+
+func (p *Issue) Due() time.Time {
+	if p.issue.DueDate == nil {
+		return time.Time{}
+	}
+	return *p.issue.DueDate
+}
+
+func (p *Issue) AddLabels(a []string) error {
+	categories, err := p.svc.categories(*p.issue.ProjectID)
+	if err != nil {
+		return err
+	}
+	ids := p.categoryIDs(nil)
+	for _, name := range a {
+		id, ok := categories[name]
+		if !ok {
+			return errors.New("unknown category: " + name)
+		}
+		ids = append(ids, id)
+	}
+	return p.setCategories(ids)
+}
+
+func (p *Issue) RemoveLabels(a []string) error {
+	return p.setCategories(p.categoryIDs(a))
+}
+
+// categoryIDs returns IDs of current categories except for excludes.
+func (p *Issue) categoryIDs(excludes []string) []int {
+	ids := make([]int, 0, len(p.issue.Category))
+L:
+	for _, c := range p.issue.Category {
+		for _, name := range excludes {
+			if c.Name != nil && *c.Name == name {
+				continue L
+			}
+		}
+		ids = append(ids, *c.ID)
+	}
+	return ids
+}
+
+func (p *Issue) setCategories(ids []int) error {
+	params := url.Values{}
+	for _, id := range ids {
+		params.Add("categoryId[]", fmt.Sprint(id))
+	}
+	if len(ids) == 0 {
+		params.Set("categoryId[]", "")
+	}
+	return p.update(params)
+}
+
+// AddAssignees assigns a user to the issue. Because Backlog issues have
+// at most one assignee, it fails if the issue is already assigned.
+func (p *Issue) AddAssignees(a []string) error {
+	if len(a) != 1 || p.issue.Assignee.ID != nil {
+		return errTooManyAssignees
+	}
+	id, err := p.svc.projectUserID(*p.issue.ProjectID, a[0])
+	if err != nil {
+		return err
+	}
+	params := url.Values{}
+	params.Set("assigneeId", fmt.Sprint(id))
+	return p.update(params)
+}
+
+func (p *Issue) RemoveAssignees(a []string) error {
+	params := url.Values{}
+	params.Set("assigneeId", "")
+	return p.update(params)
+}
+
+func (p *Issue) SetState(state string) error {
+	st, ok := states[state]
+	if !ok {
+		return errUnknownState
+	}
+	params := url.Values{}
+	params.Set("statusId", fmt.Sprint(int(st)))
+	return p.update(params)
+}
+
 func (p *Issue) Creation() time.Time {
 	return *p.issue.Created
 }
@@ -39,23 +228,135 @@ func (p *Issue) LastMod() time.Time {
 	return *p.issue.Updated
 }
 
+// Comments returns comments of the issue in posted order. Comments that
+// only record changes of the issue, such as its status, are omitted.
 func (p *Issue) Comments() ([]fs.Comment, error) {
-	return []fs.Comment{}, nil
+	var buf []*issueComment
+	minID := 0
+	for {
+		b, err := p.fetchComments(minID)
+		if err != nil {
+			return nil, err
+		}
+		for _, v := range b {
+			// minId is inclusive; the first comment of a page
+			// except the first one is the last of the previous page.
+			if v.ID > minID {
+				buf = append(buf, v)
+			}
+		}
+		if len(b) < maxComments {
+			break
+		}
+		minID = b[len(b)-1].ID
+	}
+	a := make([]fs.Comment, 0, len(buf))
+	for _, v := range buf {
+		if v.Content == nil || *v.Content == "" {
+			continue
+		}
+		a = append(a, &Comment{num: len(a) + 1, comment: v})
+	}
+	return a, nil
+}
+
+// maxComments is the maximum number of comments in a response.
+const maxComments = 100
+
+// fetchComments returns comments whose ID is greater than or equal to minID.
+func (p *Issue) fetchComments(minID int) ([]*issueComment, error) {
+	params := url.Values{}
+	params.Set("order", "asc")
+	params.Set("count", fmt.Sprint(maxComments))
+	if minID > 0 {
+		params.Set("minId", fmt.Sprint(minID))
+	}
+	var a []*issueComment
+	endpoint := fmt.Sprintf("/api/v2/issues/%s/comments", *p.issue.IssueKey)
+	if err := p.svc.do(http.MethodGet, endpoint, params, &a); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+func (p *Issue) AddComment(body string) error {
+	endpoint := fmt.Sprintf("/api/v2/issues/%s/comments", *p.issue.IssueKey)
+	params := url.Values{}
+	params.Set("content", body)
+	var v issueComment
+	if err := p.svc.do(http.MethodPost, endpoint, params, &v); err != nil {
+		return err
+	}
+	// posting a comment updates the issue
+	if !v.Updated.IsZero() {
+		issue := *p.issue
+		issue.Updated = &v.Updated
+		p.issue = &issue
+	}
+	return nil
+}
+
+func (p *Issue) Latest() (time.Time, error) {
+	var v backlog.Issue
+	endpoint := "/api/v2/issues/" + *p.issue.IssueKey
+	if err := p.svc.do(http.MethodGet, endpoint, nil, &v); err != nil {
+		return time.Time{}, err
+	}
+	return *v.Updated, nil
+}
+
+func (p *Issue) SetSubject(s string) error {
+	params := url.Values{}
+	params.Set("summary", s)
+	return p.update(params)
+}
+
+func (p *Issue) SetMessage(s string) error {
+	params := url.Values{}
+	params.Set("description", s)
+	return p.update(params)
+}
+
+func (p *Issue) update(params url.Values) error {
+	var v backlog.Issue
+	endpoint := "/api/v2/issues/" + *p.issue.IssueKey
+	if err := p.svc.do(http.MethodPatch, endpoint, params, &v); err != nil {
+		return err
+	}
+	p.issue = &v
+	return nil
 }
 
 type Config struct {
 	BaseURL string
 	APIKey  string
+	Filter  *fs.Filter // optional
 }
 
 type Service struct {
 	c      *backlog.Client
 	name   string
-	userID int
+	filter fs.Filter
+
+	// They need the network, so they are resolved at first use
+	// rather than in NewService; the service can be added offline.
+	mu          sync.Mutex // protects below
+	resolved    bool
+	userID      int
+	projectID   int // resolved from filter
+	categoryIDs []int
 }
 
 var (
-	errMissingURL = errors.New("base url is missing")
+	errMissingURL     = errors.New("base url is missing")
+	errMissingProject = errors.New("repo is missing")
+	errUnknownType    = errors.New("unknown issue type")
+	errUnknownState   = errors.New("unknown state")
+
+	errTooManyAssignees = errors.New("backlog issue can have only one assignee")
+
+	errUnsupportedFilter = errors.New("backlog doesn't support filter=mentioned")
+	errLabelsNeedProject = errors.New("labels filter requires project")
 )
 
 func NewService(config *Config) (*Service, error) {
@@ -69,32 +370,281 @@ func NewService(config *Config) (*Service, error) {
 	name := u.Host
 
 	c := backlog.NewClient(u, config.APIKey)
-	user, err := c.Myself()
+	svc := &Service{c: c, name: name}
+	if config.Filter != nil {
+		svc.filter = *config.Filter
+	}
+	if svc.filter.Filter == "mentioned" {
+		return nil, errUnsupportedFilter
+	}
+	if svc.filter.Project == "" && len(svc.filter.Labels) > 0 {
+		return nil, errLabelsNeedProject
+	}
+	return svc, nil
+}
+
+// resolve resolves the user, and the project key and category names in
+// the filter into their IDs. Once it succeeds, it does nothing.
+func (p *Service) resolve() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.resolved {
+		return nil
+	}
+	var user backlog.User
+	if err := p.do(http.MethodGet, "/api/v2/users/myself", nil, &user); err != nil {
+		return err
+	}
+	p.userID = *user.ID
+	f := &p.filter
+	if f.Project == "" {
+		p.resolved = true
+		return nil
+	}
+	proj, err := p.project(f.Project)
 	if err != nil {
-		return nil, err
+		return err
+	}
+	p.projectID = *proj.ID
+	var ids []int
+	if len(f.Labels) > 0 {
+		categories, err := p.categories(p.projectID)
+		if err != nil {
+			return err
+		}
+		for _, name := range f.Labels {
+			id, ok := categories[name]
+			if !ok {
+				return errors.New("unknown category: " + name)
+			}
+			ids = append(ids, id)
+		}
 	}
-	return &Service{c: c, name: name, userID: *user.ID}, nil
+	p.categoryIDs = ids
+	p.resolved = true
+	return nil
 }
 
+// Name returns the host name of the service. If the service is limited
+// to a project, its key is appended to the host such as host/PROJECTKEY.
 func (p *Service) Name() string {
+	if p.filter.Project != "" {
+		return p.name + "/" + p.filter.Project
+	}
 	return p.name
 }
 
+// maxIssues is the maximum number of issues in a response.
+const maxIssues = 100
+
+// List returns issues selected by the filter; by default, issues
+// that are not closed and assigned to the user unless the service is
+// limited to a project.
 func (p *Service) List() ([]fs.Task, error) {
-	l, err := p.c.IssuesWithOption(&backlog.IssuesOption{
-		AssigneeIDs: []int{p.userID},
-		Statuses: []backlog.IssueStatus{
+	if err := p.resolve(); err != nil {
+		return nil, err
+	}
+	params := url.Values{}
+	switch p.filter.Filter {
+	case "":
+		if p.projectID == 0 {
+			params.Set("assigneeId[]", fmt.Sprint(p.userID))
+		}
+	case "assigned":
+		params.Set("assigneeId[]", fmt.Sprint(p.userID))
+	case "created":
+		params.Set("createdUserId[]", fmt.Sprint(p.userID))
+	}
+	var statuses []backlog.IssueStatus
+	switch p.filter.State {
+	case "", fs.StateOpen:
+		statuses = []backlog.IssueStatus{
 			backlog.Open,
 			backlog.InProgress,
 			backlog.Resolved,
-		},
-	})
-	if err != nil {
+		}
+	case fs.StateClosed:
+		statuses = []backlog.IssueStatus{backlog.Closed}
+	}
+	for _, st := range statuses {
+		params.Add("statusId[]", fmt.Sprint(int(st)))
+	}
+	if p.projectID != 0 {
+		params.Set("projectId[]", fmt.Sprint(p.projectID))
+	}
+	for _, id := range p.categoryIDs {
+		params.Add("categoryId[]", fmt.Sprint(id))
+	}
+	if t := p.filter.Since; !t.IsZero() {
+		params.Set("updatedSince", t.Format("2006-01-02"))
+	}
+	return p.issues(params)
+}
+
+// Search returns issues that contain expr as a keyword.
+// The search is limited to the project if the service has it.
+func (p *Service) Search(expr string) ([]fs.Task, error) {
+	if err := p.resolve(); err != nil {
 		return nil, err
 	}
-	a := make([]fs.Task, len(l))
-	for i, v := range l {
-		a[i] = &Issue{issue: v, svc: p}
+	params := url.Values{}
+	params.Set("keyword", expr)
+	if p.projectID != 0 {
+		params.Set("projectId[]", fmt.Sprint(p.projectID))
+	}
+	return p.issues(params)
+}
+
+// issues returns all issues selected by params.
+func (p *Service) issues(params url.Values) ([]fs.Task, error) {
+	params.Set("count", fmt.Sprint(maxIssues))
+	var a []fs.Task
+	for {
+		params.Set("offset", fmt.Sprint(len(a)))
+		var b []*backlog.Issue
+		if err := p.do(http.MethodGet, "/api/v2/issues", params, &b); err != nil {
+			return nil, err
+		}
+		for _, v := range b {
+			a = append(a, &Issue{issue: v, svc: p})
+		}
+		if len(b) < maxIssues {
+			break
+		}
 	}
 	return a, nil
 }
+
+// Create creates an issue into the project specified by params["repo"]
+// as a project key, or the project of the service if it is omitted.
+// params["type"] selects the issue type by its name; the first type of
+// the project is used if it is omitted.
+func (p *Service) Create(params map[string]string, subject, message string) (fs.Task, error) {
+	key := params["repo"]
+	if key == "" {
+		key = p.filter.Project
+	}
+	if key == "" {
+		return nil, errMissingProject
+	}
+	proj, err := p.project(key)
+	if err != nil {
+		return nil, err
+	}
+	typeID, err := p.issueTypeID(key, params["type"])
+	if err != nil {
+		return nil, err
+	}
+	values := url.Values{}
+	values.Set("projectId", fmt.Sprint(*proj.ID))
+	values.Set("summary", subject)
+	values.Set("description", message)
+	values.Set("issueTypeId", fmt.Sprint(typeID))
+	values.Set("priorityId", fmt.Sprint(normalPriority))
+	var v backlog.Issue
+	if err := p.do(http.MethodPost, "/api/v2/issues", values, &v); err != nil {
+		return nil, err
+	}
+	return &Issue{issue: &v, svc: p}, nil
+}
+
+// categories returns a map from category names to IDs of the project.
+func (p *Service) project(key string) (*backlog.Project, error) {
+	var v backlog.Project
+	if err := p.do(http.MethodGet, "/api/v2/projects/"+url.PathEscape(key), nil, &v); err != nil {
+		return nil, err
+	}
+	return &v, nil
+}
+
+func (p *Service) categories(projectID int) (map[string]int, error) {
+	var a []*backlog.Category
+	endpoint := fmt.Sprintf("/api/v2/projects/%d/categories", projectID)
+	if err := p.do(http.MethodGet, endpoint, nil, &a); err != nil {
+		return nil, err
+	}
+	m := make(map[string]int)
+	for _, c := range a {
+		m[*c.Name] = *c.ID
+	}
+	return m, nil
+}
+
+func (p *Service) projectUserID(projectID int, userID string) (int, error) {
+	var a []*backlog.User
+	endpoint := fmt.Sprintf("/api/v2/projects/%d/users", projectID)
+	if err := p.do(http.MethodGet, endpoint, nil, &a); err != nil {
+		return 0, err
+	}
+	for _, u := range a {
+		if u.UserID != nil && *u.UserID == userID {
+			return *u.ID, nil
+		}
+	}
+	return 0, errors.New("unknown user: " + userID)
+}
+
+// normalPriority is the ID of "Normal" priority in Backlog.
+const normalPriority = 3
+
+func (p *Service) issueTypeID(key, name string) (int, error) {
+	var types []*backlog.IssueType
+	endpoint := fmt.Sprintf("/api/v2/projects/%s/issueTypes", key)
+	if err := p.do(http.MethodGet, endpoint, nil, &types); err != nil {
+		return 0, err
+	}
+	for _, t := range types {
+		if name == "" || *t.Name == name {
+			return *t.ID, nil
+		}
+	}
+	return 0, errUnknownType
+}
+
+// do calls Backlog API directly because the client treats responses
+// other than 200 OK, such as 201 Created, as an empty body, and its
+// errors don't tell the status code.
+func (p *Service) do(method, endpoint string, params url.Values, v interface{}) error {
+	u := *p.c.BaseURL
+	u.Path = path.Join(u.Path, endpoint)
+	q := url.Values{}
+	q.Set("apiKey", p.c.APIKey)
+	var body io.Reader
+	if method == http.MethodGet {
+		for k, a := range params {
+			q[k] = a
+		}
+	} else {
+		body = strings.NewReader(params.Encode())
+	}
+	u.RawQuery = q.Encode()
+	req, err := http.NewRequest(method, u.String(), body)
+	if err != nil {
+		return err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	}
+	hc := p.c.HTTPClient
+	if hc == nil {
+		hc = http.DefaultClient
+	}
+	resp, err := hc.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		var e backlog.BacklogErrorResponse
+		json.NewDecoder(resp.Body).Decode(&e)
+		err := fmt.Errorf("%s %s: %s", method, endpoint, resp.Status)
+		if len(e.Errors) > 0 {
+			err = errors.New(e.Errors[0].Message)
+		}
+		return &fs.HTTPError{StatusCode: resp.StatusCode, Err: err}
+	}
+	if v == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
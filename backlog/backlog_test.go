@@ -0,0 +1,151 @@
+package backlog
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"testing"
+	"time"
+
+	backlog "github.com/griffin-stewie/go-backlog"
+
+	"github.com/lufia/taskfs/fs"
+)
+
+// commentServer serves n comments of an issue like Backlog API.
+// Comments whose ID is a multiple of 50 have no content.
+func commentServer(t *testing.T, n int) *httptest.Server {
+	t.Helper()
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/api/v2/issues/PRJ-1/comments" {
+			http.NotFound(w, r)
+			return
+		}
+		q := r.URL.Query()
+		if q.Get("order") != "asc" {
+			t.Errorf("order = %q; want asc", q.Get("order"))
+		}
+		count, _ := strconv.Atoi(q.Get("count"))
+		minID, _ := strconv.Atoi(q.Get("minId"))
+		a := make([]*issueComment, 0, count)
+		for id := max(minID, 1); id <= n && len(a) < count; id++ {
+			content := fmt.Sprintf("comment %d", id)
+			if id%50 == 0 {
+				content = ""
+			}
+			a = append(a, &issueComment{
+				ID:      id,
+				Content: &content,
+				Created: time.Date(2024, 1, 1, 0, id, 0, 0, time.UTC),
+			})
+		}
+		json.NewEncoder(w).Encode(a)
+	}))
+}
+
+func TestComments(t *testing.T) {
+	srv := commentServer(t, 250)
+	defer srv.Close()
+	svc, err := NewService(&Config{BaseURL: srv.URL, APIKey: "key"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	key := "PRJ-1"
+	issue := &Issue{issue: &backlog.Issue{IssueKey: &key}, svc: svc}
+	a, err := issue.Comments()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(a) != 245 {
+		t.Fatalf("len(Comments) = %d; want 245", len(a))
+	}
+	id := 0
+	for i, c := range a {
+		if want := strconv.Itoa(i + 1); c.Key() != want {
+			t.Errorf("Key = %q; want %q", c.Key(), want)
+		}
+		var n int
+		if _, err := fmt.Sscanf(c.Message(), "comment %d", &n); err != nil {
+			t.Fatalf("Message = %q: %v", c.Message(), err)
+		}
+		if n <= id {
+			t.Errorf("comment %d follows comment %d", n, id)
+		}
+		if n%50 == 0 {
+			t.Errorf("comment %d has no content", n)
+		}
+		id = n
+	}
+	if id != 249 {
+		t.Errorf("last comment = %d; want 249", id)
+	}
+}
+
+// listServer serves the user, the project PRJ and no issues like
+// Backlog API. Queries of issue requests are sent to queries.
+// Requests with API keys other than "key" are rejected.
+func listServer(t *testing.T, queries chan<- url.Values) *httptest.Server {
+	t.Helper()
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("apiKey") != "key" {
+			w.WriteHeader(http.StatusUnauthorized)
+			fmt.Fprint(w, `{"errors":[{"message":"Authentication failure.","code":11}]}`)
+			return
+		}
+		switch r.URL.Path {
+		case "/api/v2/users/myself":
+			fmt.Fprint(w, `{"id":1,"userId":"user","name":"user"}`)
+		case "/api/v2/projects/PRJ":
+			fmt.Fprint(w, `{"id":2,"projectKey":"PRJ","name":"project"}`)
+		case "/api/v2/issues":
+			queries <- r.URL.Query()
+			fmt.Fprint(w, `[]`)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+}
+
+func TestListAssignee(t *testing.T) {
+	tests := []struct {
+		filter fs.Filter
+		want   string
+	}{
+		{filter: fs.Filter{}, want: "1"},
+		{filter: fs.Filter{Filter: "assigned"}, want: "1"},
+		{filter: fs.Filter{Project: "PRJ"}, want: ""},
+		{filter: fs.Filter{Project: "PRJ", Filter: "assigned"}, want: "1"},
+	}
+	for _, tt := range tests {
+		queries := make(chan url.Values, 1)
+		srv := listServer(t, queries)
+		svc, err := NewService(&Config{BaseURL: srv.URL, APIKey: "key", Filter: &tt.filter})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := svc.List(); err != nil {
+			t.Errorf("List(%+v): %v", tt.filter, err)
+		} else if s := (<-queries).Get("assigneeId[]"); s != tt.want {
+			t.Errorf("List(%+v): assigneeId[] = %q; want %q", tt.filter, s, tt.want)
+		}
+		srv.Close()
+	}
+}
+
+func TestListUnauthorized(t *testing.T) {
+	srv := listServer(t, nil)
+	defer srv.Close()
+	svc, err := NewService(&Config{BaseURL: srv.URL, APIKey: "invalid"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = svc.List()
+	var e *fs.HTTPError
+	if !errors.As(err, &e) || e.StatusCode != http.StatusUnauthorized {
+		t.Errorf("List: %v; want HTTPError with %d", err, http.StatusUnauthorized)
+	}
+}
@@ -0,0 +1,313 @@
+package fs
+
+import (
+	"encoding/json"
+	"errors"
+	"net/url"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// diskCache stores tasks and comments of a service into a directory
+// to serve them while the service is unreachable. A nil *diskCache
+// stores nothing.
+type diskCache struct {
+	dir string
+}
+
+var errNoCache = errors.New("no cache")
+
+// newDiskCache returns a diskCache of the service name under dir.
+// It returns nil if dir is empty.
+func newDiskCache(dir, name string) *diskCache {
+	if dir == "" {
+		return nil
+	}
+	return &diskCache{dir: filepath.Join(dir, url.PathEscape(name))}
+}
+
+type taskRecord struct {
+	Key       string
+	Subject   string
+	Message   string
+	PermaLink string
+	State     string
+	Creation  time.Time
+	LastMod   time.Time
+	Labels    []string  `json:",omitempty"`
+	Assignees []string  `json:",omitempty"`
+	Author    string    `json:",omitempty"`
+	Milestone string    `json:",omitempty"`
+	Due       time.Time `json:",omitempty"`
+	Path      []string  `json:",omitempty"`
+}
+
+type commentRecord struct {
+	Key      string
+	Message  string
+	Creation time.Time
+	LastMod  time.Time
+}
+
+func (c *diskCache) saveTasks(a []Task) error {
+	if c == nil {
+		return nil
+	}
+	records := make([]*taskRecord, len(a))
+	for i, task := range a {
+		r := &taskRecord{
+			Key:       task.Key(),
+			Subject:   task.Subject(),
+			Message:   task.Message(),
+			PermaLink: task.PermaLink(),
+			State:     task.State(),
+			Creation:  task.Creation(),
+			LastMod:   task.LastMod(),
+		}
+		if m, ok := task.(Metadata); ok {
+			r.Labels = m.Labels()
+			r.Assignees = m.Assignees()
+			r.Author = m.Author()
+			r.Milestone = m.Milestone()
+			r.Due = m.Due()
+		}
+		if l, ok := task.(Locator); ok {
+			r.Path = l.Path()
+		}
+		records[i] = r
+	}
+	return c.write("tasks.json", records)
+}
+
+func (c *diskCache) loadTasks() ([]Task, error) {
+	if c == nil {
+		return nil, errNoCache
+	}
+	var records []*taskRecord
+	if err := c.read("tasks.json", &records); err != nil {
+		return nil, err
+	}
+	a := make([]Task, len(records))
+	for i, r := range records {
+		a[i] = &storedTask{r: r, cache: c}
+	}
+	return a, nil
+}
+
+func (c *diskCache) saveComments(key string, a []Comment) error {
+	if c == nil {
+		return nil
+	}
+	records := make([]*commentRecord, len(a))
+	for i, v := range a {
+		records[i] = &commentRecord{
+			Key:      v.Key(),
+			Message:  v.Message(),
+			Creation: v.Creation(),
+			LastMod:  v.LastMod(),
+		}
+	}
+	return c.write(commentsFile(key), records)
+}
+
+func (c *diskCache) loadComments(key string) ([]Comment, error) {
+	if c == nil {
+		return nil, errNoCache
+	}
+	var records []*commentRecord
+	if err := c.read(commentsFile(key), &records); err != nil {
+		return nil, err
+	}
+	a := make([]Comment, len(records))
+	for i, r := range records {
+		a[i] = &storedComment{r: r}
+	}
+	return a, nil
+}
+
+func commentsFile(key string) string {
+	return filepath.Join("comments", url.PathEscape(key)+".json")
+}
+
+// write writes v into the file atomically. Each write uses its own
+// temporary file because the same file can be written concurrently.
+func (c *diskCache) write(file string, v interface{}) error {
+	file = filepath.Join(c.dir, file)
+	dir := filepath.Dir(file)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+	b, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	f, err := os.CreateTemp(dir, filepath.Base(file)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	tmp := f.Name()
+	_, err = f.Write(b)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp, file)
+	}
+	if err != nil {
+		os.Remove(tmp)
+	}
+	return err
+}
+
+func (c *diskCache) read(file string, v interface{}) error {
+	b, err := os.ReadFile(filepath.Join(c.dir, file))
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, v)
+}
+
+// storedTask is a task restored from diskCache.
+type storedTask struct {
+	r     *taskRecord
+	cache *diskCache
+}
+
+func (t *storedTask) Key() string {
+	return t.r.Key
+}
+
+func (t *storedTask) Subject() string {
+	return t.r.Subject
+}
+
+func (t *storedTask) Message() string {
+	return t.r.Message
+}
+
+func (t *storedTask) PermaLink() string {
+	return t.r.PermaLink
+}
+
+func (t *storedTask) State() string {
+	return t.r.State
+}
+
+func (t *storedTask) Creation() time.Time {
+	return t.r.Creation
+}
+
+func (t *storedTask) LastMod() time.Time {
+	return t.r.LastMod
+}
+
+func (t *storedTask) Labels() []string {
+	return t.r.Labels
+}
+
+func (t *storedTask) Assignees() []string {
+	return t.r.Assignees
+}
+
+func (t *storedTask) Author() string {
+	return t.r.Author
+}
+
+func (t *storedTask) Milestone() string {
+	return t.r.Milestone
+}
+
+func (t *storedTask) Due() time.Time {
+	return t.r.Due
+}
+
+func (t *storedTask) Path() []string {
+	return t.r.Path
+}
+
+func (t *storedTask) Comments() ([]Comment, error) {
+	a, err := t.cache.loadComments(t.r.Key)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	return a, err
+}
+
+// Writes to a storedTask always fail with errOffline,
+// then they are queued into the outbox.
+
+func (t *storedTask) AddComment(body string) error {
+	return errOffline
+}
+
+func (t *storedTask) Latest() (time.Time, error) {
+	return time.Time{}, errOffline
+}
+
+func (t *storedTask) SetSubject(s string) error {
+	return errOffline
+}
+
+func (t *storedTask) SetMessage(s string) error {
+	return errOffline
+}
+
+func (t *storedTask) SetState(state string) error {
+	return errOffline
+}
+
+func (t *storedTask) AddLabels(a []string) error {
+	return errOffline
+}
+
+func (t *storedTask) RemoveLabels(a []string) error {
+	return errOffline
+}
+
+func (t *storedTask) AddAssignees(a []string) error {
+	return errOffline
+}
+
+func (t *storedTask) RemoveAssignees(a []string) error {
+	return errOffline
+}
+
+// offlineError is returned when the task is restored from diskCache.
+// It behaves as a network error.
+type offlineError struct{}
+
+var errOffline error = offlineError{}
+
+func (offlineError) Error() string {
+	return "service is offline"
+}
+
+func (offlineError) Timeout() bool {
+	return false
+}
+
+func (offlineError) Temporary() bool {
+	return true
+}
+
+// storedComment is a comment restored from diskCache.
+type storedComment struct {
+	r *commentRecord
+}
+
+func (c *storedComment) Key() string {
+	return c.r.Key
+}
+
+func (c *storedComment) Message() string {
+	return c.r.Message
+}
+
+func (c *storedComment) Creation() time.Time {
+	return c.r.Creation
+}
+
+func (c *storedComment) LastMod() time.Time {
+	return c.r.LastMod
+}
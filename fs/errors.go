@@ -0,0 +1,87 @@
+package fs
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+// HTTPError is an error with the status code of an HTTP response.
+// Services wrap errors returned from their API with HTTPError
+// so that taskfs can report them as suitable errno values.
+type HTTPError struct {
+	StatusCode int
+	Err        error
+}
+
+func (e *HTTPError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *HTTPError) Unwrap() error {
+	return e.Err
+}
+
+// statusCode returns the HTTP status code that caused err.
+// It returns 0 if err is not an HTTPError.
+func statusCode(err error) int {
+	var e *HTTPError
+	if errors.As(err, &e) {
+		return e.StatusCode
+	}
+	return 0
+}
+
+// maxErrors is the number of errors kept in an errors file.
+const maxErrors = 20
+
+// errorLog keeps recent errors of a directory and shows them in its
+// errors file.
+type errorLog struct {
+	file *Text
+
+	mu sync.Mutex // protects below
+	a  []string
+}
+
+func newErrorLog() *errorLog {
+	now := time.Now()
+	return &errorLog{
+		file: &Text{
+			Node: NewNode(),
+			FileInfo: FileInfo{
+				Name:     "errors",
+				Mode:     0444,
+				Creation: now,
+				LastMod:  now,
+			},
+		},
+	}
+}
+
+// record appends err caused by op to the log.
+func (l *errorLog) record(op string, err error) {
+	now := time.Now()
+	s := fmt.Sprintf("%s %s: %v\n", now.Format(time.RFC3339), op, err)
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.a = append(l.a, s)
+	if len(l.a) > maxErrors {
+		l.a = l.a[len(l.a)-maxErrors:]
+	}
+	l.file.set([]byte(strings.Join(l.a, "")), now)
+	invalidate(l.file)
+}
+
+// recorded returns fn that records its error as op.
+func (l *errorLog) recorded(op string, fn func(p []byte, since time.Time) error) func(p []byte, since time.Time) error {
+	return func(p []byte, since time.Time) error {
+		err := fn(p, since)
+		if err != nil {
+			l.record(op, err)
+		}
+		return err
+	}
+}
@@ -4,19 +4,56 @@ package fs
 file structure:
 
 mtpt/
+	ctl
+	errors
 	github/
+		ctl
+		status
+		pending
+		errors
+		ratelimit
+		new
 		1000111/
 			subject
 			message
-			1
-			2
-			3...
+			url
+			state
+			labels
+			assignees
+			author
+			milestone
+			due
+			ctl
+			new
+			comments/
+				1
+				2
+				3...
+		.search/
+			is:open label:bug/
+				1000111/
+					...
+		lufia/		(layout=tree)
+			taskfs/
+				1/
+					subject
+					...
+	gitlab.com/
+		group/
+			app/
+				ctl
+				...
 */
 
 import (
 	"errors"
+	"fmt"
 	"os"
+	"path"
+	"slices"
+	"sort"
 	"strings"
+	"sync"
 	"time"
 )
 
@@ -27,21 +64,111 @@ type Comment interface {
 	LastMod() time.Time
 }
 
+// States of a task. Services may have their own states in addition to these.
+const (
+	StateOpen   = "open"
+	StateClosed = "closed"
+)
+
 type Task interface {
 	Key() string
 	Subject() string
 	Message() string
 	PermaLink() string
+	State() string
 	Creation() time.Time
 	LastMod() time.Time
 	Comments() ([]Comment, error)
 }
 
+// Commenter is implemented by a Task that can post a new comment.
+type Commenter interface {
+	AddComment(body string) error
+}
+
+// Editor is implemented by a Task that can update its subject and message.
+type Editor interface {
+	// Latest returns the last modified time of the task on the server.
+	Latest() (time.Time, error)
+	SetSubject(s string) error
+	SetMessage(s string) error
+}
+
+// Metadata is implemented by a Task that has additional attributes.
+// Due returns zero time if the task doesn't have a due date.
+type Metadata interface {
+	Labels() []string
+	Assignees() []string
+	Author() string
+	Milestone() string
+	Due() time.Time
+}
+
+// Locator is implemented by a Task that can be placed in the tree layout.
+// Path returns elements of the path to the task directory, such as
+// the owner, the repository and the number.
+type Locator interface {
+	Path() []string
+}
+
+// Labeler is implemented by a Task that can change its labels.
+type Labeler interface {
+	AddLabels(a []string) error
+	RemoveLabels(a []string) error
+}
+
+// Assigner is implemented by a Task that can change its assignees.
+type Assigner interface {
+	AddAssignees(a []string) error
+	RemoveAssignees(a []string) error
+}
+
+// StateChanger is implemented by a Task that can change its state.
+type StateChanger interface {
+	SetState(state string) error
+}
+
 type Service interface {
 	Name() string
 	List() ([]Task, error)
 }
 
+// Creator is implemented by a Service that can create a new task.
+// params holds the header fields of the draft except subject.
+type Creator interface {
+	Create(params map[string]string, subject, message string) (Task, error)
+}
+
+// Filter selects tasks listed by a Service. Zero values mean the defaults
+// of the service. Services return an error if they can't handle it.
+type Filter struct {
+	Filter  string // assigned, created, mentioned or all
+	State   string // open, closed or all
+	Labels  []string
+	Project string
+	Since   time.Time // tasks updated since the time
+}
+
+// Invalidator is implemented by a Service that keeps tasks between
+// List calls to fetch only differences. Invalidate discards them so
+// that next List fetches all tasks.
+type Invalidator interface {
+	Invalidate()
+}
+
+// RateLimiter is implemented by a Service that knows its API quota.
+// RateLimit returns known quotas of each resource of the API.
+type RateLimiter interface {
+	RateLimit() []RateLimit
+}
+
+type RateLimit struct {
+	Resource  string // such as "core"; empty if the API has a single quota
+	Limit     int
+	Remaining int
+	Reset     time.Time
+}
+
 type FileInfo struct {
 	Name     string
 	Size     int64
@@ -54,6 +181,13 @@ func (f *FileInfo) IsDir() bool {
 	return f.Mode&os.ModeDir != 0
 }
 
+// MountOptions are options for MountAndServe.
+type MountOptions struct {
+	Debug        bool
+	AttrTimeout  time.Duration
+	EntryTimeout time.Duration
+}
+
 type Dir interface {
 	Node
 	Stat() *FileInfo
@@ -63,28 +197,128 @@ type Dir interface {
 
 var errProtocol = errors.New("protocol botch")
 
+// ErrConflict is returned when a task was modified on the server
+// after it had been fetched.
+var ErrConflict = errors.New("task was modified on the server")
+
 type Root struct {
 	Node
 	FileInfo
-	registers map[string]func(token, url string) (Service, error)
-	services  map[string]Service
+	registers map[string]func(token, url string, filter *Filter) (Service, error)
+	ctl       *Ctl
+	errors    *errorLog
+
+	mu       sync.Mutex // protects below
+	services map[string]*ServiceDir
+	paths    map[string]*PathDir // intermediate directories by prefix
+	args     map[string][]string // arguments of add command for each service
+	config   string
+	cacheDir string
 }
 
 func NewRoot() *Root {
 	now := time.Now()
-	return &Root{
+	root := &Root{
 		Node: NewNode(),
 		FileInfo: FileInfo{
 			Mode:     os.ModeDir | 0755,
 			Creation: now,
 			LastMod:  now,
 		},
-		registers: make(map[string]func(token, url string) (Service, error)),
-		services:  make(map[string]Service),
+		registers: make(map[string]func(token, url string, filter *Filter) (Service, error)),
+		services:  make(map[string]*ServiceDir),
+		paths:     make(map[string]*PathDir),
+		args:      make(map[string][]string),
+		errors:    newErrorLog(),
+	}
+	root.ctl = &Ctl{
+		Node: NewNode(),
+		FileInfo: FileInfo{
+			Name:     "ctl",
+			Mode:     0644,
+			Creation: now,
+			LastMod:  now,
+		},
+		Commands: map[string]func(args ...string) error{
+			"add":     root.addService,
+			"remove":  root.removeService,
+			"refresh": root.refresh,
+			"save":    root.saveConfig,
+		},
+		Status: root.status,
+		errors: root.errors,
 	}
+	return root
 }
 
-func (root *Root) RegisterService(kind string, fn func(token, url string) (Service, error)) {
+// LoadConfig adds services listed in file. Each line of the file has
+// the same arguments as add command of the ctl file. Blank lines and
+// lines starting with '#' are ignored. The file is also used for
+// save command; it is not an error that the file doesn't exist yet.
+func (root *Root) LoadConfig(file string) error {
+	root.mu.Lock()
+	root.config = file
+	root.mu.Unlock()
+	data, err := os.ReadFile(file)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	for i, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if err := root.addService(tokenize(line)...); err != nil {
+			return fmt.Errorf("%s:%d: %w", file, i+1, err)
+		}
+	}
+	return nil
+}
+
+// SetCacheDir sets the directory to store fetched tasks. Services added
+// after the call serve stored tasks while they are unreachable.
+func (root *Root) SetCacheDir(dir string) {
+	root.mu.Lock()
+	root.cacheDir = dir
+	root.mu.Unlock()
+}
+
+func (root *Root) saveConfig(args ...string) error {
+	root.mu.Lock()
+	defer root.mu.Unlock()
+	file := root.config
+	switch len(args) {
+	case 0:
+		if file == "" {
+			return errors.New("config file is not specified")
+		}
+	case 1:
+		file = args[0]
+	default:
+		return errors.New("invalid save command")
+	}
+	names := make([]string, 0, len(root.args))
+	for name := range root.args {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var b strings.Builder
+	for _, name := range names {
+		for i, arg := range root.args[name] {
+			if i > 0 {
+				b.WriteByte(' ')
+			}
+			b.WriteString(quote(arg))
+		}
+		b.WriteByte('\n')
+	}
+	return os.WriteFile(file, []byte(b.String()), 0600)
+}
+
+func (root *Root) RegisterService(kind string, fn func(token, url string, filter *Filter) (Service, error)) {
 	if _, ok := root.registers[kind]; ok {
 		panic("duplicate service register: " + kind)
 	}
@@ -96,22 +330,374 @@ func (root *Root) Stat() *FileInfo {
 }
 
 func (root *Root) ReadDir() ([]Dir, error) {
+	root.mu.Lock()
+	defer root.mu.Unlock()
+	dirs := root.children("")
+	dirs = append(dirs, root.ctl, root.errors.file)
+	return dirs, nil
+}
+
+// children returns services and intermediate directories just under
+// prefix. A service named "github.com/org/repo" is placed in
+// github.com/org directory. If a service is named as the directory,
+// such as github.com, the directory is placed in the service directory
+// instead; see nest. It must be called while holding root.mu.
+func (root *Root) children(prefix string) []Dir {
+	var dirs []Dir
+	seen := make(map[string]bool)
+	for name, dir := range root.services {
+		if !strings.HasPrefix(name, prefix) {
+			continue
+		}
+		rest := name[len(prefix):]
+		i := strings.IndexByte(rest, '/')
+		if i < 0 {
+			dirs = append(dirs, dir)
+			continue
+		}
+		p := prefix + rest[:i+1]
+		if seen[p] {
+			continue
+		}
+		seen[p] = true
+		if root.services[p[:len(p)-1]] != nil {
+			continue
+		}
+		d := root.paths[p]
+		if d == nil {
+			d = newPathDir(root, p)
+			root.paths[p] = d
+		}
+		dirs = append(dirs, d)
+	}
+	return dirs
+}
+
+// parent returns the directory that contains the service name,
+// and the base name of the service.
+// It must be called while holding root.mu.
+func (root *Root) parent(name string) (Dir, string) {
+	i := strings.LastIndexByte(name, '/')
+	if i < 0 {
+		return root, name
+	}
+	if s := root.services[name[:i]]; s != nil {
+		return s, name[i+1:]
+	}
+	d := root.paths[name[:i+1]]
+	if d == nil {
+		return nil, name[i+1:]
+	}
+	return d, name[i+1:]
+}
+
+// detach removes the service name from the tree, and intermediate
+// directories that become empty.
+// It must be called while holding root.mu.
+func (root *Root) detach(name string) {
+	for {
+		dir, base := root.parent(name)
+		if dir != nil {
+			removeChild(dir, base)
+		}
+		prefix := name[:len(name)-len(base)]
+		if prefix == "" || len(root.children(prefix)) > 0 {
+			return
+		}
+		if root.services[prefix[:len(prefix)-1]] != nil {
+			return
+		}
+		delete(root.paths, prefix)
+		name = strings.TrimSuffix(prefix, "/")
+	}
+}
+
+// nest places services and intermediate directories into the service
+// whose name is their prefix, such as github.com/org into github.com,
+// so that a service limited to a project coexists with the service of
+// the same host. It must be called while holding root.mu.
+func (root *Root) nest() {
+	for name, dir := range root.services {
+		a := root.children(name + "/")
+		sort.Slice(a, func(i, j int) bool {
+			return a[i].Stat().Name < a[j].Stat().Name
+		})
+		dir.setSubdirs(a)
+	}
+}
+
+// addService adds a service. args are kind, token, optional url and
+// options formatted as name=value.
+func (root *Root) addService(args ...string) error {
+	var kind, token, url string
+	var a []string
+	for i, arg := range args {
+		if i >= 2 && isOption(arg) {
+			a = append(a, arg)
+			continue
+		}
+		switch i {
+		case 0:
+			kind = arg
+		case 1:
+			token = arg
+		default:
+			if url != "" {
+				return errors.New("invalid add command")
+			}
+			url = arg
+		}
+	}
+	if token == "" {
+		return errors.New("invalid add command")
+	}
+	register := root.registers[kind]
+	if register == nil {
+		return errors.New("unsupported service type: " + kind)
+	}
+	opts, err := parseOptions(a)
+	if err != nil {
+		return err
+	}
+	token, err = resolveToken(token)
+	if err != nil {
+		return err
+	}
+	srv, err := register(token, url, &opts.filter)
+	if err != nil {
+		return err
+	}
+	root.mu.Lock()
+	defer root.mu.Unlock()
+	cache := newDiskCache(root.cacheDir, srv.Name())
+	dir := newServiceDir(srv, opts, cache, nil)
+	if old := root.services[srv.Name()]; old != nil {
+		old.stop()
+		root.detach(srv.Name())
+	}
+	root.services[srv.Name()] = dir
+	root.args[srv.Name()] = args
+	root.nest()
+	dir.start()
+	return nil
+}
+
+func (root *Root) removeService(args ...string) error {
+	if len(args) != 1 {
+		return errors.New("invalid remove command")
+	}
+	name := args[0]
+	root.mu.Lock()
+	defer root.mu.Unlock()
+	dir, ok := root.services[name]
+	if !ok {
+		return errors.New("service not found: " + name)
+	}
+	dir.stop()
+	delete(root.services, name)
+	delete(root.args, name)
+	root.detach(name)
+	root.nest()
+	return nil
+}
+
+// refresh invalidates caches of all services. They are refreshed without
+// holding root.mu so that the mount point is available meanwhile.
+func (root *Root) refresh(args ...string) error {
+	root.mu.Lock()
+	dirs := make([]*ServiceDir, 0, len(root.services))
+	for _, dir := range root.services {
+		dirs = append(dirs, dir)
+	}
+	root.mu.Unlock()
+	for _, dir := range dirs {
+		dir.refreshCache()
+	}
+	return nil
+}
+
+// status returns registered service kinds and active services.
+// Tokens are redacted unless they are references such as env:NAME.
+func (root *Root) status() []byte {
+	root.mu.Lock()
+	defer root.mu.Unlock()
+	var b strings.Builder
+	kinds := make([]string, 0, len(root.registers))
+	for kind := range root.registers {
+		kinds = append(kinds, kind)
+	}
+	sort.Strings(kinds)
+	for _, kind := range kinds {
+		fmt.Fprintf(&b, "kind %s\n", kind)
+	}
+	names := make([]string, 0, len(root.args))
+	for name := range root.args {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		args := append([]string(nil), root.args[name]...)
+		if !isTokenRef(args[1]) {
+			args[1] = "*"
+		}
+		for i := range args {
+			args[i] = quote(args[i])
+		}
+		fmt.Fprintf(&b, "service %s %s\n", name, strings.Join(args, " "))
+	}
+	return []byte(b.String())
+}
+
+func (*Root) ReadFile() ([]byte, error) {
+	return nil, errProtocol
+}
+
+// PathDir is an intermediate directory of services whose names contain
+// slashes, such as github.com/org/repo.
+type PathDir struct {
+	Node
+	FileInfo
+	root   *Root
+	prefix string // such as "github.com/org/"
+}
+
+func newPathDir(root *Root, prefix string) *PathDir {
 	now := time.Now()
-	dirs := make([]Dir, 0, len(root.services)+1) // +1: ctl file
-	for name, svc := range root.services {
-		dir := &ServiceDir{
+	return &PathDir{
+		Node: NewNode(),
+		FileInfo: FileInfo{
+			Name:     path.Base(prefix),
+			Mode:     os.ModeDir | 0755,
+			Creation: now,
+			LastMod:  now,
+		},
+		root:   root,
+		prefix: prefix,
+	}
+}
+
+func (dir *PathDir) Stat() *FileInfo {
+	return &dir.FileInfo
+}
+
+func (dir *PathDir) ReadDir() ([]Dir, error) {
+	dir.root.mu.Lock()
+	defer dir.root.mu.Unlock()
+	return dir.root.children(dir.prefix), nil
+}
+
+func (*PathDir) ReadFile() ([]byte, error) {
+	return nil, errProtocol
+}
+
+type ServiceDir struct {
+	Node
+	FileInfo
+	svc    Service
+	opts   *serviceOptions
+	store  *diskCache
+	status *Text
+	outbox *outbox
+	errors *errorLog
+	parent *ServiceDir // service of the query directory; nil for others
+	search *SearchDir  // nil if the service can't search tasks
+	files  []Dir       // files other than tasks
+	done   chan struct{}
+
+	// workers limits prefetch workers; nil if prefetch is disabled.
+	// Query directories share it with their service.
+	workers chan struct{}
+
+	// loadMu serializes loading the task list, that calls the service
+	// without holding mu. It must be taken before mu.
+	loadMu sync.Mutex
+
+	mu      sync.Mutex // protects below
+	cache   []Dir
+	tasks   map[string]*TaskDir
+	list    []*TaskDir           // tasks in the order of the service
+	groups  map[string]*GroupDir // directories of the tree layout by prefix
+	subdirs []Dir                // services under the service; see Root.nest
+	loaded  time.Time
+	full    time.Time // last time the whole list was requested
+	offline bool
+}
+
+// offlineRetry is the interval to retry fetching while the service is offline.
+const offlineRetry = 30 * time.Second
+
+// fullListInterval is the maximum interval to fetch the whole task list
+// from services that implement Invalidator. Between them, they fetch only
+// tasks updated since the last fetch, so tasks that no longer match the
+// filter, such as unassigned ones, remain until the next full listing.
+const fullListInterval = 15 * time.Minute
+
+// newServiceDir returns a directory of svc. If parent is not nil, the
+// directory is a query directory of parent; it shares the outbox and
+// the error log with parent, and operations queued from it are
+// replayed by parent.
+func newServiceDir(svc Service, opts *serviceOptions, store *diskCache, parent *ServiceDir) *ServiceDir {
+	now := time.Now()
+	dir := &ServiceDir{
+		Node: NewNode(),
+		FileInfo: FileInfo{
+			Name:     path.Base(svc.Name()),
+			Mode:     os.ModeDir | 0755,
+			Creation: now,
+			LastMod:  now,
+		},
+		svc:   svc,
+		opts:  opts,
+		store: store,
+		status: &Text{
 			Node: NewNode(),
 			FileInfo: FileInfo{
-				Name:     name,
-				Mode:     os.ModeDir | 0755,
+				Name:     "status",
+				Mode:     0444,
 				Creation: now,
 				LastMod:  now,
 			},
-			svc: svc,
-		}
-		dirs = append(dirs, dir)
+		},
+		parent: parent,
+		done:   make(chan struct{}),
+		tasks:  make(map[string]*TaskDir),
+	}
+	dir.setStatus(nil)
+	if opts.prefetch > 0 {
+		dir.workers = make(chan struct{}, opts.prefetch)
 	}
-	dirs = append(dirs, &Ctl{
+	if parent != nil {
+		dir.workers = parent.workers
+		dir.outbox = parent.outbox
+		dir.errors = parent.errors
+		dir.files = append(dir.files, dir.status, &Ctl{
+			Node: NewNode(),
+			FileInfo: FileInfo{
+				Name:     "ctl",
+				Mode:     0644,
+				Creation: now,
+				LastMod:  now,
+			},
+			Commands: map[string]func(args ...string) error{
+				"refresh": dir.refreshCache,
+			},
+			errors: dir.errors,
+		})
+		return dir
+	}
+	dir.errors = newErrorLog()
+	pending := &Text{
+		Node: NewNode(),
+		FileInfo: FileInfo{
+			Name:     "pending",
+			Mode:     0444,
+			Creation: now,
+			LastMod:  now,
+		},
+	}
+	dir.outbox = newOutbox(store, pending)
+	dir.files = append(dir.files, dir.status, pending, dir.errors.file)
+	dir.files = append(dir.files, &Ctl{
 		Node: NewNode(),
 		FileInfo: FileInfo{
 			Name:     "ctl",
@@ -120,128 +706,926 @@ func (root *Root) ReadDir() ([]Dir, error) {
 			LastMod:  now,
 		},
 		Commands: map[string]func(args ...string) error{
-			"add": root.addService,
+			"refresh": dir.refreshCache,
+			"flush":   dir.flushOutbox,
+			"drop":    dir.outbox.drop,
 		},
+		errors: dir.errors,
 	})
-	return dirs, nil
+	if l, ok := svc.(RateLimiter); ok {
+		dir.files = append(dir.files, &Ctl{
+			Node: NewNode(),
+			FileInfo: FileInfo{
+				Name:     "ratelimit",
+				Mode:     0444,
+				Creation: now,
+				LastMod:  now,
+			},
+			Status: func() []byte {
+				return rateLimitStatus(l.RateLimit())
+			},
+		})
+	}
+	if _, ok := svc.(Creator); ok {
+		dir.files = append(dir.files, &Text{
+			Node: NewNode(),
+			FileInfo: FileInfo{
+				Name:     "new",
+				Mode:     0644,
+				Creation: now,
+				LastMod:  now,
+			},
+			commit: dir.errors.recorded("new", dir.createTask),
+		})
+	}
+	if _, ok := svc.(Searcher); ok {
+		dir.search = newSearchDir(dir, store)
+		dir.files = append(dir.files, dir.search)
+	}
+	return dir
 }
 
-func (root *Root) addService(args ...string) error {
-	var kind, token, url string
-	switch len(args) {
-	case 3:
-		url = args[2]
-		fallthrough
-	case 2:
-		token = args[1]
-		kind = args[0]
-		register := root.registers[kind]
-		if register == nil {
-			return errors.New("unsupported service type: " + kind)
-		}
-		srv, err := register(token, url)
-		if err != nil {
-			return err
-		}
-		root.services[srv.Name()] = srv
-		return nil
-	default:
-		return errors.New("invalid add command")
+// start starts background refresh if it is enabled.
+func (dir *ServiceDir) start() {
+	if dir.opts.poll > 0 {
+		go dir.poll()
+	}
+	if dir.search != nil {
+		dir.search.start()
 	}
 }
 
-func (*Root) ReadFile() ([]byte, error) {
-	return nil, errProtocol
+func (dir *ServiceDir) stop() {
+	close(dir.done)
+	if dir.search != nil {
+		dir.search.stop()
+	}
 }
 
-type ServiceDir struct {
-	Node
-	FileInfo
-	svc   Service
-	cache []Dir
+func (dir *ServiceDir) poll() {
+	t := time.NewTicker(dir.opts.poll)
+	defer t.Stop()
+	for {
+		select {
+		case <-dir.done:
+			return
+		case <-t.C:
+			dir.loadMu.Lock()
+			_, err := dir.load()
+			dir.loadMu.Unlock()
+			if err == nil {
+				reconcile(dir)
+			}
+		}
+	}
 }
 
 func (dir *ServiceDir) Stat() *FileInfo {
 	return &dir.FileInfo
 }
 
+// ReadDir returns the cached task list unless it is expired, even while
+// the list is being loaded in background.
 func (dir *ServiceDir) ReadDir() ([]Dir, error) {
-	if dir.cache != nil {
-		return dir.cache, nil
+	if cache := dir.cached(); cache != nil {
+		return cache, nil
+	}
+	dir.loadMu.Lock()
+	defer dir.loadMu.Unlock()
+	// the list might have been loaded while waiting for loadMu
+	if cache := dir.cached(); cache != nil {
+		return cache, nil
+	}
+	return dir.load()
+}
+
+// cached returns the task list if it is not expired, otherwise nil.
+func (dir *ServiceDir) cached() []Dir {
+	dir.mu.Lock()
+	defer dir.mu.Unlock()
+	ttl := dir.opts.ttl
+	if dir.offline && (ttl == 0 || ttl > offlineRetry) {
+		ttl = offlineRetry
+	}
+	if dir.cache != nil && !expired(dir.loaded, ttl) {
+		return dir.cache
+	}
+	return nil
+}
+
+// rateLimitStatus returns the content of ratelimit file.
+// Quotas of resources are separated by blank lines.
+func rateLimitStatus(a []RateLimit) []byte {
+	if len(a) == 0 {
+		return []byte("unknown\n")
+	}
+	var b strings.Builder
+	for i, l := range a {
+		if i > 0 {
+			b.WriteByte('\n')
+		}
+		if l.Resource != "" {
+			fmt.Fprintf(&b, "resource %s\n", l.Resource)
+		}
+		fmt.Fprintf(&b, "limit %d\n", l.Limit)
+		fmt.Fprintf(&b, "remaining %d\n", l.Remaining)
+		if !l.Reset.IsZero() {
+			fmt.Fprintf(&b, "reset %s\n", l.Reset.Format(time.RFC3339))
+		}
+	}
+	return []byte(b.String())
+}
+
+// setStatus updates the status file with err.
+// It must be called while holding dir.mu.
+func (dir *ServiceDir) setStatus(err error) {
+	now := time.Now()
+	s := "online\n"
+	if err != nil {
+		s = fmt.Sprintf("offline %s: %v\n", now.Format(time.RFC3339), err)
+	}
+	dir.status.set([]byte(s), now)
+	invalidate(dir.status)
+}
+
+// expired reports whether the data loaded at t is expired.
+// Zero ttl means the data never expires.
+func expired(t time.Time, ttl time.Duration) bool {
+	return ttl > 0 && time.Since(t) >= ttl
+}
+
+// load fetches the task list and merges it into the cache, then returns
+// the new cache. TaskDirs of tasks that already exist are reused so that
+// their inodes stay valid. The service is called without holding dir.mu,
+// so the old cache is available while loading.
+// It must be called while holding dir.loadMu.
+func (dir *ServiceDir) load() ([]Dir, error) {
+	if v, ok := dir.svc.(Invalidator); ok {
+		d := dir.opts.ttl
+		if d == 0 || d > fullListInterval {
+			d = fullListInterval
+		}
+		dir.mu.Lock()
+		full := expired(dir.full, d)
+		if full {
+			dir.full = time.Now()
+		}
+		dir.mu.Unlock()
+		if full {
+			v.Invalidate()
+		}
 	}
 	a, err := dir.svc.List()
+	if err == nil {
+		dir.store.saveTasks(a)
+	} else {
+		dir.errors.record("list", err)
+		var cerr error
+		a, cerr = dir.store.loadTasks()
+		if cerr != nil {
+			return nil, err
+		}
+	}
+	cache, changed := dir.merge(a, err)
+	if err == nil && dir.parent == nil {
+		dir.flush(false)
+		if dir.opts.prefetch > 0 && len(changed) > 0 {
+			go dir.prefetch(changed)
+		}
+	}
+	return cache, nil
+}
+
+// merge replaces the task list with a, then returns the new cache and
+// tasks that are new or updated. err is the error of fetching a.
+func (dir *ServiceDir) merge(a []Task, err error) ([]Dir, []*TaskDir) {
+	dir.mu.Lock()
+	defer dir.mu.Unlock()
+	if err != nil || dir.offline {
+		dir.offline = err != nil
+		dir.setStatus(err)
+	}
+	tasks := make(map[string]*TaskDir, len(a))
+	list := make([]*TaskDir, 0, len(a))
+	var changed []*TaskDir
+	for _, task := range a {
+		td := dir.tasks[task.Key()]
+		if td == nil {
+			td = dir.newTaskDir(task)
+			changed = append(changed, td)
+		} else if td.update(task) {
+			changed = append(changed, td)
+		}
+		tasks[task.Key()] = td
+		list = append(list, td)
+	}
+	dir.tasks = tasks
+	dir.list = list
+	dir.arrange()
+	dir.loaded = time.Now()
+	return dir.cache, changed
+}
+
+// maxPrefetch is the maximum number of tasks to prefetch at a time.
+const maxPrefetch = 50
+
+// prefetch loads comments of at most maxPrefetch tasks, recently updated
+// ones first. Workers are limited to opts.prefetch in total even if
+// prefetch runs overlap.
+func (dir *ServiceDir) prefetch(a []*TaskDir) {
+	sort.Slice(a, func(i, j int) bool {
+		return a[i].Stat().LastMod.After(a[j].Stat().LastMod)
+	})
+	if len(a) > maxPrefetch {
+		a = a[:maxPrefetch]
+	}
+	var wg sync.WaitGroup
+	defer wg.Wait()
+	for _, td := range a {
+		select {
+		case <-dir.done:
+			return
+		case dir.workers <- struct{}{}:
+		}
+		wg.Add(1)
+		go func(td *TaskDir) {
+			defer wg.Done()
+			td.comments.ReadDir()
+			<-dir.workers
+		}(td)
+	}
+}
+
+// flushOutbox replays queued operations.
+func (dir *ServiceDir) flushOutbox(args ...string) error {
+	dir.loadMu.Lock()
+	defer dir.loadMu.Unlock()
+	dir.mu.Lock()
+	stale := dir.cache == nil || dir.offline
+	dir.mu.Unlock()
+	if stale {
+		if _, err := dir.load(); err != nil {
+			return err
+		}
+		dir.mu.Lock()
+		offline := dir.offline
+		dir.mu.Unlock()
+		if offline {
+			return errOffline
+		}
+	}
+	return dir.flush(true)
+}
+
+// flush replays queued operations in order. It stops at the first
+// operation that fails by the network; other failures are recorded
+// to the operation and it stays in the outbox until it is dropped.
+// Such operations will fail again, so they are retried only if explicit
+// is true, that is, by flush command.
+// It must be called while holding dir.loadMu.
+func (dir *ServiceDir) flush(explicit bool) error {
+	for _, op := range dir.outbox.list() {
+		if op.Err != "" && !explicit {
+			continue
+		}
+		var err error
+		if op.Op == opCreate {
+			err = dir.replayCreate(op)
+		} else if td := dir.lookupTask(op.Key); td != nil {
+			err = td.replay(op)
+		} else {
+			err = fmt.Errorf("task %s not found", op.Key)
+		}
+		if err != nil && isNetworkError(err) {
+			return err
+		}
+		if err != nil {
+			dir.outbox.fail(op.ID, err)
+			continue
+		}
+		dir.outbox.remove(op.ID)
+	}
+	return nil
+}
+
+// lookupTask returns the TaskDir of key in the service or its query
+// directories.
+func (dir *ServiceDir) lookupTask(key string) *TaskDir {
+	dir.mu.Lock()
+	td := dir.tasks[key]
+	dir.mu.Unlock()
+	if td == nil && dir.search != nil {
+		td = dir.search.lookupTask(key)
+	}
+	return td
+}
+
+// replayCreate creates a task from the draft queued in op.
+func (dir *ServiceDir) replayCreate(op *operation) error {
+	task, err := dir.create(op.Args[0])
+	if err != nil {
+		return err
+	}
+	dir.mu.Lock()
+	defer dir.mu.Unlock()
+	dir.addTask(task)
+	return nil
+}
+
+// createTask creates a task from the draft p. The draft consists of
+// header lines such as "subject: title", a blank line and a message.
+// If the service is unreachable, the draft is queued into the outbox.
+func (dir *ServiceDir) createTask(p []byte, _ time.Time) error {
+	s := string(p)
+	if len(strings.TrimSpace(s)) == 0 {
+		return nil
+	}
+	task, err := dir.create(s)
+	if err != nil && isNetworkError(err) {
+		dir.outbox.add(&operation{
+			Op:   opCreate,
+			Args: []string{s},
+		})
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	dir.mu.Lock()
+	defer dir.mu.Unlock()
+	dir.addTask(task)
+	return nil
+}
+
+func (dir *ServiceDir) create(s string) (Task, error) {
+	params, msg, err := parseDraft(s)
 	if err != nil {
 		return nil, err
 	}
-	dirs := make([]Dir, len(a)+1)
-	for i, task := range a {
-		dirs[i] = &TaskDir{
-			Node: NewNode(),
-			FileInfo: FileInfo{
-				Name:     task.Key(),
-				Mode:     os.ModeDir | 0755,
-				Creation: task.Creation(),
-				LastMod:  task.LastMod(),
-			},
-			task: task,
+	subject := params["subject"]
+	if subject == "" {
+		return nil, errors.New("subject is missing")
+	}
+	delete(params, "subject")
+	c := dir.svc.(Creator)
+	return c.Create(params, subject, msg)
+}
+
+// addTask adds task to the cache.
+// It must be called while holding dir.mu.
+func (dir *ServiceDir) addTask(task Task) {
+	if dir.cache == nil {
+		return
+	}
+	td := dir.newTaskDir(task)
+	dir.tasks[task.Key()] = td
+	n := len(dir.list)
+	dir.list = append(dir.list[:n:n], td)
+	dir.arrange()
+	invalidate(dir)
+	if g := dir.groups[td.prefix()]; g != nil {
+		invalidate(g)
+	}
+}
+
+// arrange builds entries of the service directory from dir.list.
+// In the tree layout, tasks are placed in group directories by their
+// paths; GroupDirs are reused so that their inodes stay valid.
+// Callers of ReadDir may hold old slices, so they are always rebuilt.
+// A group in the service directory that has the same name as a file or
+// a subdirectory of the service, such as ctl of the owner "ctl", is
+// renamed to "@ctl"; services don't allow '@' in the names of owners
+// and projects. It must be called while holding dir.mu.
+func (dir *ServiceDir) arrange() {
+	dirs := make([]Dir, 0, len(dir.list)+len(dir.files)+len(dir.subdirs))
+	groups := make(map[string]*GroupDir)
+	for _, td := range dir.list {
+		entries := &dirs
+		prefix := ""
+		for _, name := range td.path[:max(len(td.path)-1, 0)] {
+			prefix += name + "/"
+			g := groups[prefix]
+			if g == nil {
+				if entries == &dirs && dir.reserved(name) {
+					name = "@" + name
+				}
+				g = dir.groups[prefix]
+				if g == nil || g.Name != name {
+					g = newGroupDir(dir, prefix, name)
+				}
+				g.entries = nil
+				groups[prefix] = g
+				*entries = append(*entries, g)
+			}
+			entries = &g.entries
+		}
+		*entries = append(*entries, td)
+	}
+	dirs = append(dirs, dir.files...)
+	dir.cache = append(dirs, dir.subdirs...)
+	dir.groups = groups
+}
+
+// reserved reports whether name is used by a file or a subdirectory
+// of the service. It must be called while holding dir.mu.
+func (dir *ServiceDir) reserved(name string) bool {
+	for _, f := range dir.files {
+		if f.Stat().Name == name {
+			return true
+		}
+	}
+	for _, d := range dir.subdirs {
+		if d.Stat().Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// setSubdirs replaces subdirectories of the service with a.
+func (dir *ServiceDir) setSubdirs(a []Dir) {
+	dir.mu.Lock()
+	defer dir.mu.Unlock()
+	if slices.Equal(a, dir.subdirs) {
+		return
+	}
+	dir.subdirs = a
+	if dir.cache != nil {
+		dir.arrange()
+	}
+	invalidate(dir)
+}
+
+func parseDraft(s string) (map[string]string, string, error) {
+	params := make(map[string]string)
+	for s != "" {
+		var line string
+		if i := strings.IndexByte(s, '\n'); i >= 0 {
+			line, s = s[:i], s[i+1:]
+		} else {
+			line, s = s, ""
+		}
+		if strings.TrimSpace(line) == "" {
+			break
+		}
+		i := strings.IndexByte(line, ':')
+		if i < 0 {
+			return nil, "", errors.New("invalid header: " + line)
 		}
+		key := strings.ToLower(strings.TrimSpace(line[:i]))
+		params[key] = strings.TrimSpace(line[i+1:])
 	}
+	return params, s, nil
+}
+
+// refreshCache invalidates the task list and contents of all tasks.
+func (dir *ServiceDir) refreshCache(args ...string) error {
+	dir.mu.Lock()
+	defer dir.mu.Unlock()
+	dir.full = time.Time{} // next load fetches the whole list
+	dir.cache = nil
+	for _, td := range dir.tasks {
+		td.refresh()
+	}
+	invalidate(dir)
+	if dir.search != nil {
+		dir.search.refresh()
+	}
+	return nil
+}
+
+func (*ServiceDir) ReadFile() ([]byte, error) {
+	return nil, errProtocol
+}
+
+// GroupDir is a directory of the tree layout, such as an owner or
+// a repository, that contains tasks or other groups.
+type GroupDir struct {
+	Node
+	FileInfo
+	svc    *ServiceDir
+	prefix string // such as "lufia/taskfs/"
+
+	entries []Dir // protected by svc.mu
+}
+
+func newGroupDir(svc *ServiceDir, prefix, name string) *GroupDir {
 	now := time.Now()
-	dirs[len(dirs)-1] = &Ctl{
+	return &GroupDir{
 		Node: NewNode(),
 		FileInfo: FileInfo{
-			Name:     "ctl",
-			Mode:     0644,
+			Name:     name,
+			Mode:     os.ModeDir | 0755,
 			Creation: now,
 			LastMod:  now,
 		},
-		Commands: map[string]func(args ...string) error{
-			"refresh": dir.refreshCache,
-		},
+		svc:    svc,
+		prefix: prefix,
 	}
-	dir.cache = dirs
-	return dirs, nil
 }
 
-func (dir *ServiceDir) refreshCache(args ...string) error {
-	dir.cache = nil
-	return nil
+func (g *GroupDir) Stat() *FileInfo {
+	return &g.FileInfo
 }
 
-func (*ServiceDir) ReadFile() ([]byte, error) {
+func (g *GroupDir) ReadDir() ([]Dir, error) {
+	// reload the task list if it was expired
+	if _, err := g.svc.ReadDir(); err != nil {
+		return nil, err
+	}
+	g.svc.mu.Lock()
+	defer g.svc.mu.Unlock()
+	if g.svc.groups[g.prefix] != g {
+		// the group disappeared from the task list
+		return nil, nil
+	}
+	return g.entries, nil
+}
+
+func (*GroupDir) ReadFile() ([]byte, error) {
 	return nil, errProtocol
 }
 
+// TaskDir is a directory of a task. Task is not safe for concurrent use;
+// operations to the task must be done while holding taskMu, and others
+// that read the task must hold it for reading. Operations call the
+// service, so taskMu is held across network calls. On the other hand,
+// mu is held only for a moment so that Stat never waits for the network.
+// The lock order is taskMu, then mu.
 type TaskDir struct {
 	Node
+
+	ttl      time.Duration
+	store    *diskCache
+	outbox   *outbox
+	errors   *errorLog
+	comments *CommentsDir
+	path     []string // path in the tree layout; nil in the flat layout
+
+	taskMu sync.RWMutex
+
+	mu sync.Mutex // protects below and fields of comments
 	FileInfo
 	task  Task
 	files []Dir
 }
 
+func (dir *ServiceDir) newTaskDir(task Task) *TaskDir {
+	td := &TaskDir{
+		Node:   NewNode(),
+		ttl:    dir.opts.taskTTL,
+		store:  dir.store,
+		outbox: dir.outbox,
+		errors: dir.errors,
+		FileInfo: FileInfo{
+			Name:     task.Key(),
+			Mode:     os.ModeDir | 0755,
+			Creation: task.Creation(),
+			LastMod:  task.LastMod(),
+		},
+		task: task,
+	}
+	if l, ok := task.(Locator); ok && dir.opts.layout == layoutTree {
+		if p := l.Path(); len(p) > 0 {
+			td.path = p
+			td.Name = p[len(p)-1]
+		}
+	}
+	td.comments = &CommentsDir{
+		Node: NewNode(),
+		dir:  td,
+	}
+	return td
+}
+
+// prefix returns the path of the group that contains the task in the tree
+// layout, or an empty string if the task is in the service directory.
+func (dir *TaskDir) prefix() string {
+	if len(dir.path) < 2 {
+		return ""
+	}
+	return strings.Join(dir.path[:len(dir.path)-1], "/") + "/"
+}
+
+// update replaces the task with newly fetched one if it was modified.
+// A task restored from the disk is always replaced. It reports whether
+// the task was replaced. An operation in progress keeps using the old
+// task, so update doesn't wait for it.
+func (dir *TaskDir) update(task Task) bool {
+	dir.mu.Lock()
+	defer dir.mu.Unlock()
+	_, stored := dir.task.(*storedTask)
+	if !stored && task.LastMod().Equal(dir.LastMod) {
+		return false
+	}
+	dir.task = task
+	dir.LastMod = task.LastMod()
+	dir.files = nil
+	invalidate(dir)
+	dir.resetComments()
+	return true
+}
+
+// refresh invalidates the contents of the task directory.
+func (dir *TaskDir) refresh(args ...string) error {
+	dir.mu.Lock()
+	defer dir.mu.Unlock()
+	dir.files = nil
+	invalidate(dir)
+	dir.resetComments()
+	return nil
+}
+
+// resetComments makes comments be fetched at next read.
+// It must be called while holding dir.mu.
+func (dir *TaskDir) resetComments() {
+	dir.comments.files = nil
+	dir.comments.gen++
+	invalidate(dir.comments)
+}
+
 func (dir *TaskDir) Stat() *FileInfo {
-	return &dir.FileInfo
+	dir.mu.Lock()
+	defer dir.mu.Unlock()
+	info := dir.FileInfo
+	return &info
+}
+
+// current returns the task.
+func (dir *TaskDir) current() Task {
+	dir.mu.Lock()
+	defer dir.mu.Unlock()
+	return dir.task
 }
 
 func (dir *TaskDir) ReadDir() ([]Dir, error) {
+	dir.mu.Lock()
+	files := dir.files
+	dir.mu.Unlock()
+	if files != nil {
+		return files, nil
+	}
+	dir.taskMu.RLock()
+	defer dir.taskMu.RUnlock()
+	dir.mu.Lock()
+	defer dir.mu.Unlock()
 	if dir.files != nil {
 		return dir.files, nil
 	}
-	a, err := dir.task.Comments()
-	if err != nil {
-		return nil, err
+	kids := make([]Dir, 0, 12)
+	subject := dir.newText("subject", dir.task.Subject())
+	message := dir.newText("message", dir.task.Message())
+	if _, ok := dir.task.(Editor); ok {
+		subject.commit = dir.recorded(subject, dir.editFunc(subject, opSubject))
+		message.commit = dir.recorded(message, dir.editFunc(message, opMessage))
 	}
-	kids := make([]Dir, 0, len(a)+3)
-	kids = append(kids, dir.newText("subject", dir.task.Subject()))
-	kids = append(kids, dir.newText("message", dir.task.Message()))
+	kids = append(kids, subject, message)
 	kids = append(kids, dir.newText("url", dir.task.PermaLink()))
-	for _, c := range a {
-		kids = append(kids, NewCommentText(c))
+	state := dir.newText("state", dir.task.State())
+	kids = append(kids, state)
+	if m, ok := dir.task.(Metadata); ok {
+		var due string
+		if t := m.Due(); !t.IsZero() {
+			due = t.Format("2006-01-02")
+		}
+		labels := dir.newText("labels", lines(m.Labels()))
+		if _, ok := dir.task.(Labeler); ok {
+			labels.commit = dir.recorded(labels, dir.updateFunc(labels, Metadata.Labels, opAddLabels, opRemoveLabels))
+		}
+		assignees := dir.newText("assignees", lines(m.Assignees()))
+		if _, ok := dir.task.(Assigner); ok {
+			assignees.commit = dir.recorded(assignees, dir.updateFunc(assignees, Metadata.Assignees, opAddAssignees, opRemoveAssignees))
+		}
+		kids = append(kids, labels, assignees)
+		kids = append(kids, dir.newText("author", m.Author()))
+		kids = append(kids, dir.newText("milestone", m.Milestone()))
+		kids = append(kids, dir.newText("due", due))
+	}
+	cmds := map[string]func(args ...string) error{
+		"refresh": dir.refresh,
 	}
+	if _, ok := dir.task.(StateChanger); ok {
+		setState := func(s string) error {
+			dir.taskMu.Lock()
+			defer dir.taskMu.Unlock()
+			queued, err := dir.perform(&operation{
+				Op:   opState,
+				Args: []string{s},
+			})
+			if err != nil {
+				return err
+			}
+			if queued {
+				dir.touch(state, []byte(s))
+			} else {
+				dir.touch(state, []byte(dir.current().State()))
+			}
+			return nil
+		}
+		cmds["close"] = func(args ...string) error {
+			return setState(StateClosed)
+		}
+		cmds["reopen"] = func(args ...string) error {
+			return setState(StateOpen)
+		}
+		cmds["state"] = func(args ...string) error {
+			if len(args) != 1 {
+				return errors.New("invalid state command")
+			}
+			return setState(args[0])
+		}
+	}
+	kids = append(kids, &Ctl{
+		Node: NewNode(),
+		FileInfo: FileInfo{
+			Name:     "ctl",
+			Mode:     0644,
+			Creation: dir.task.Creation(),
+			LastMod:  dir.task.LastMod(),
+		},
+		Commands: cmds,
+		errors:   dir.errors,
+		prefix:   dir.task.Key() + "/ctl ",
+	})
+	if _, ok := dir.task.(Commenter); ok {
+		t := dir.newText("new", "")
+		t.commit = dir.recorded(t, dir.commentFunc(t))
+		kids = append(kids, t)
+	}
+	kids = append(kids, dir.comments)
 	dir.files = kids
 	return dir.files, nil
 }
 
+// commentFunc returns a function that posts a comment written to t.
+func (dir *TaskDir) commentFunc(t *Text) func(p []byte, since time.Time) error {
+	return func(p []byte, _ time.Time) error {
+		s := strings.TrimSpace(string(p))
+		if s == "" {
+			return nil
+		}
+		dir.taskMu.Lock()
+		defer dir.taskMu.Unlock()
+		queued, err := dir.perform(&operation{
+			Op:   opComment,
+			Args: []string{s},
+		})
+		if err != nil {
+			return err
+		}
+		if !queued {
+			dir.mu.Lock()
+			dir.resetComments()
+			dir.mu.Unlock()
+			dir.touch(t, nil)
+		}
+		return nil
+	}
+}
+
+// editFunc returns a function that updates t with op. It refuses to
+// overwrite the task if it was modified on the server after since,
+// the time t was opened.
+func (dir *TaskDir) editFunc(t *Text, op string) func(p []byte, since time.Time) error {
+	return func(p []byte, since time.Time) error {
+		dir.taskMu.Lock()
+		defer dir.taskMu.Unlock()
+		s := string(p)
+		if op == opSubject {
+			s = strings.TrimSpace(s)
+		}
+		_, err := dir.perform(&operation{
+			Op:    op,
+			Args:  []string{s},
+			Since: since,
+		})
+		if err != nil {
+			return err
+		}
+		dir.touch(t, append([]byte(nil), p...))
+		return nil
+	}
+}
+
+// updateFunc returns a function that compares lines written to t with
+// the current values, then applies the differences with addOp and removeOp.
+func (dir *TaskDir) updateFunc(t *Text, get func(m Metadata) []string, addOp, removeOp string) func(p []byte, since time.Time) error {
+	return func(p []byte, _ time.Time) error {
+		dir.taskMu.Lock()
+		defer dir.taskMu.Unlock()
+		current := func() []string {
+			return get(dir.current().(Metadata))
+		}
+		want := make(map[string]bool)
+		for _, s := range strings.Split(string(p), "\n") {
+			if s = strings.TrimSpace(s); s != "" {
+				want[s] = true
+			}
+		}
+		var added, removed []string
+		have := make(map[string]bool)
+		for _, s := range current() {
+			have[s] = true
+			if !want[s] {
+				removed = append(removed, s)
+			}
+		}
+		for s := range want {
+			if !have[s] {
+				added = append(added, s)
+			}
+		}
+		sort.Strings(added)
+		var queued bool
+		if len(removed) > 0 {
+			q, err := dir.perform(&operation{
+				Op:   removeOp,
+				Args: removed,
+			})
+			if err != nil {
+				return err
+			}
+			queued = queued || q
+		}
+		if len(added) > 0 {
+			q, err := dir.perform(&operation{
+				Op:   addOp,
+				Args: added,
+			})
+			if err != nil {
+				return err
+			}
+			queued = queued || q
+		}
+		if queued {
+			a := make([]string, 0, len(want))
+			for s := range want {
+				a = append(a, s)
+			}
+			sort.Strings(a)
+			dir.touch(t, []byte(lines(a)))
+		} else {
+			dir.touch(t, []byte(lines(current())))
+		}
+		return nil
+	}
+}
+
+// perform applies op to the task. If the service is unreachable, op is
+// queued into the outbox and perform reports it was queued.
+// It must be called while holding dir.taskMu.
+func (dir *TaskDir) perform(op *operation) (queued bool, err error) {
+	task := dir.current()
+	op.Key = task.Key()
+	err = op.apply(task)
+	if err != nil && isNetworkError(err) {
+		dir.outbox.add(op)
+		return true, nil
+	}
+	return false, err
+}
+
+// replay applies op queued in the outbox to the task.
+func (dir *TaskDir) replay(op *operation) error {
+	dir.taskMu.Lock()
+	defer dir.taskMu.Unlock()
+	if err := op.apply(dir.current()); err != nil {
+		return err
+	}
+	dir.mu.Lock()
+	defer dir.mu.Unlock()
+	dir.files = nil
+	invalidate(dir)
+	dir.resetComments()
+	return nil
+}
+
+// recorded returns commit that records its error with the path of t.
+func (dir *TaskDir) recorded(t *Text, commit func(p []byte, since time.Time) error) func(p []byte, since time.Time) error {
+	return dir.errors.recorded(dir.task.Key()+"/"+t.Name, commit)
+}
+
+// touch replaces the content of t with p after the task was updated.
+// Any update changes LastMod of the task on the server, so LastMod of
+// the other files is also moved forward; otherwise the next edit of
+// them would conflict with the user's own update.
+// It must be called while holding dir.taskMu.
+func (dir *TaskDir) touch(t *Text, p []byte) {
+	dir.mu.Lock()
+	dir.LastMod = dir.task.LastMod()
+	mtime := dir.LastMod
+	files := dir.files
+	dir.mu.Unlock()
+	for _, f := range files {
+		if f, ok := f.(*Text); ok && f != t {
+			f.advance(mtime)
+		}
+	}
+	t.set(p, mtime)
+	invalidate(t)
+	invalidate(dir)
+}
+
 func (*TaskDir) ReadFile() ([]byte, error) {
 	return nil, errProtocol
 }
@@ -261,14 +1645,33 @@ func (dir *TaskDir) newText(name, s string) *Text {
 	}
 }
 
+// lines joins a with newlines. Each element is terminated by a newline.
+func lines(a []string) string {
+	var b strings.Builder
+	for _, s := range a {
+		b.WriteString(s)
+		b.WriteByte('\n')
+	}
+	return b.String()
+}
+
+// Text is a file in TaskDir. If commit is set, Text is writable and
+// data written to it is passed to commit when the file is closed,
+// with LastMod of the Text at the time the file was opened.
 type Text struct {
 	Node
+	commit func(p []byte, since time.Time) error
+
+	mu sync.Mutex // protects below
 	FileInfo
 	data []byte
 }
 
 func (t *Text) Stat() *FileInfo {
-	return &t.FileInfo
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	info := t.FileInfo
+	return &info
 }
 
 func (t *Text) ReadDir() ([]Dir, error) {
@@ -277,9 +1680,101 @@ func (t *Text) ReadDir() ([]Dir, error) {
 }
 
 func (t *Text) ReadFile() ([]byte, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
 	return t.data, nil
 }
 
+func (t *Text) set(p []byte, mtime time.Time) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.data = p
+	t.Size = int64(len(p))
+	t.LastMod = mtime
+}
+
+// advance sets LastMod of t to mtime if it is newer.
+func (t *Text) advance(mtime time.Time) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if mtime.After(t.LastMod) {
+		t.LastMod = mtime
+	}
+}
+
+func (t *Text) Writable() bool {
+	return t.commit != nil
+}
+
+func (t *Text) WriteFile(p []byte, since time.Time) error {
+	if t.commit == nil {
+		return errProtocol
+	}
+	return t.commit(p, since)
+}
+
+// CommentsDir is a directory of comments of a task. Comments are
+// fetched when the directory is read, rather than when the task is.
+type CommentsDir struct {
+	Node
+	dir *TaskDir
+
+	// protected by dir.mu
+	files  []Dir
+	loaded time.Time
+	gen    int // incremented when comments are reset
+}
+
+func (c *CommentsDir) Stat() *FileInfo {
+	info := c.dir.Stat()
+	info.Name = "comments"
+	return info
+}
+
+// ReadDir fetches comments without holding dir.mu, so that other files
+// of the task are available while comments are being loaded.
+func (c *CommentsDir) ReadDir() ([]Dir, error) {
+	dir := c.dir
+	dir.mu.Lock()
+	files, gen := c.files, c.gen
+	if files != nil && !expired(c.loaded, dir.ttl) {
+		dir.mu.Unlock()
+		return files, nil
+	}
+	dir.mu.Unlock()
+
+	dir.taskMu.RLock()
+	defer dir.taskMu.RUnlock()
+	task := dir.current()
+	a, err := task.Comments()
+	if err == nil {
+		dir.store.saveComments(task.Key(), a)
+	} else {
+		dir.errors.record(task.Key()+"/comments", err)
+		var cerr error
+		a, cerr = dir.store.loadComments(task.Key())
+		if cerr != nil {
+			return nil, err
+		}
+	}
+	files = make([]Dir, len(a))
+	for i, v := range a {
+		files[i] = NewCommentText(v)
+	}
+	dir.mu.Lock()
+	defer dir.mu.Unlock()
+	// comments might be reset while they were fetched
+	if c.gen == gen {
+		c.files = files
+		c.loaded = time.Now()
+	}
+	return files, nil
+}
+
+func (*CommentsDir) ReadFile() ([]byte, error) {
+	return nil, errProtocol
+}
+
 type CommentText struct {
 	Node
 	FileInfo
@@ -317,6 +1812,9 @@ type Ctl struct {
 	Node
 	FileInfo
 	Commands map[string]func(args ...string) error
+	Status   func() []byte // optional: content of the file
+	errors   *errorLog     // optional: records failed commands
+	prefix   string        // prefix of commands in errors
 }
 
 func (ctl *Ctl) Stat() *FileInfo {
@@ -328,14 +1826,17 @@ func (ctl *Ctl) ReadDir() ([]Dir, error) {
 }
 
 func (ctl *Ctl) ReadFile() ([]byte, error) {
-	return []byte{}, nil
+	if ctl.Status == nil {
+		return []byte{}, nil
+	}
+	return ctl.Status(), nil
 }
 
 func (ctl *Ctl) WriteFile(p []byte) error {
 	s := string(p)
 	cmds := strings.Split(s, "\n")
 	for _, cmd := range cmds {
-		a := strings.Fields(cmd)
+		a := tokenize(cmd)
 		if len(a) == 0 {
 			return nil
 		}
@@ -344,8 +1845,56 @@ func (ctl *Ctl) WriteFile(p []byte) error {
 			return errors.New("unknown control command")
 		}
 		if err := fn(a[1:]...); err != nil {
+			// arguments are omitted because they might contain a token
+			if ctl.errors != nil {
+				ctl.errors.record(ctl.prefix+a[0], err)
+			}
 			return err
 		}
 	}
 	return nil
 }
+
+// tokenize splits s into fields separated by white spaces. Like rc(1),
+// a field can be quoted with single quotes, and two quotes in a quoted
+// field represent a quote.
+func tokenize(s string) []string {
+	var (
+		a      []string
+		b      strings.Builder
+		quoted bool
+		inword bool
+	)
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case quoted && c == '\'' && i+1 < len(s) && s[i+1] == '\'':
+			b.WriteByte(c)
+			i++
+		case c == '\'':
+			quoted = !quoted
+			inword = true
+		case !quoted && (c == ' ' || c == '\t' || c == '\r'):
+			if inword {
+				a = append(a, b.String())
+				b.Reset()
+				inword = false
+			}
+		default:
+			b.WriteByte(c)
+			inword = true
+		}
+	}
+	if inword {
+		a = append(a, b.String())
+	}
+	return a
+}
+
+// quote returns s quoted to be split by tokenize if needed.
+func quote(s string) string {
+	if s != "" && !strings.ContainsAny(s, " \t\r'") {
+		return s
+	}
+	return "'" + strings.ReplaceAll(s, "'", "''") + "'"
+}
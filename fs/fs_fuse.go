@@ -4,7 +4,11 @@
 package fs
 
 import (
+	"errors"
+	"net/http"
 	"os"
+	"sync"
+	"syscall"
 	"time"
 
 	"github.com/hanwen/go-fuse/fuse"
@@ -39,11 +43,11 @@ func (f *FileInfo) FillDirEntry(out *fuse.DirEntry) {
 	}
 }
 
-func (root *Root) MountAndServe(mtpt string, debug bool) error {
+func (root *Root) MountAndServe(mtpt string, o *MountOptions) error {
 	opts := nodefs.Options{
-		AttrTimeout:  time.Second,
-		EntryTimeout: time.Second,
-		Debug:        debug,
+		AttrTimeout:  o.AttrTimeout,
+		EntryTimeout: o.EntryTimeout,
+		Debug:        o.Debug,
 	}
 	s, _, err := nodefs.MountRoot(mtpt, root, &opts)
 	if err != nil {
@@ -53,6 +57,14 @@ func (root *Root) MountAndServe(mtpt string, debug bool) error {
 	return nil
 }
 
+// connector is used to notify the kernel of changes of the tree.
+// It is set when the root is mounted.
+var connector *nodefs.FileSystemConnector
+
+func (root *Root) OnMount(conn *nodefs.FileSystemConnector) {
+	connector = conn
+}
+
 func (root *Root) Lookup(out *fuse.Attr, name string, ctx *fuse.Context) (*nodefs.Inode, fuse.Status) {
 	return lookupName(root, name, out, ctx)
 }
@@ -66,6 +78,32 @@ func (root *Root) OpenDir(ctx *fuse.Context) ([]fuse.DirEntry, fuse.Status) {
 	return readDir(root)
 }
 
+func (dir *PathDir) Lookup(out *fuse.Attr, name string, ctx *fuse.Context) (*nodefs.Inode, fuse.Status) {
+	return lookupName(dir, name, out, ctx)
+}
+
+func (dir *PathDir) GetAttr(out *fuse.Attr, file nodefs.File, ctx *fuse.Context) fuse.Status {
+	dir.FileInfo.FillAttr(out)
+	return fuse.OK
+}
+
+func (dir *PathDir) OpenDir(ctx *fuse.Context) ([]fuse.DirEntry, fuse.Status) {
+	return readDir(dir)
+}
+
+func (g *GroupDir) Lookup(out *fuse.Attr, name string, ctx *fuse.Context) (*nodefs.Inode, fuse.Status) {
+	return lookupName(g, name, out, ctx)
+}
+
+func (g *GroupDir) GetAttr(out *fuse.Attr, file nodefs.File, ctx *fuse.Context) fuse.Status {
+	g.FileInfo.FillAttr(out)
+	return fuse.OK
+}
+
+func (g *GroupDir) OpenDir(ctx *fuse.Context) ([]fuse.DirEntry, fuse.Status) {
+	return readDir(g)
+}
+
 func (dir *ServiceDir) Lookup(out *fuse.Attr, name string, ctx *fuse.Context) (*nodefs.Inode, fuse.Status) {
 	return lookupName(dir, name, out, ctx)
 }
@@ -79,12 +117,47 @@ func (dir *ServiceDir) OpenDir(ctx *fuse.Context) ([]fuse.DirEntry, fuse.Status)
 	return readDir(dir)
 }
 
+func (dir *SearchDir) Lookup(out *fuse.Attr, name string, ctx *fuse.Context) (*nodefs.Inode, fuse.Status) {
+	return lookupName(dir, name, out, ctx)
+}
+
+func (dir *SearchDir) GetAttr(out *fuse.Attr, file nodefs.File, ctx *fuse.Context) fuse.Status {
+	dir.FileInfo.FillAttr(out)
+	return fuse.OK
+}
+
+func (dir *SearchDir) OpenDir(ctx *fuse.Context) ([]fuse.DirEntry, fuse.Status) {
+	return readDir(dir)
+}
+
+func (dir *SearchDir) Mkdir(name string, mode uint32, ctx *fuse.Context) (*nodefs.Inode, fuse.Status) {
+	if err := dir.mkdir(name); err != nil {
+		return nil, errorStatus(err, fuse.EIO)
+	}
+	if _, status := readDir(dir); status != fuse.OK {
+		return nil, status
+	}
+	c := dir.Inode().GetChild(name)
+	if c == nil {
+		return nil, fuse.ENOENT
+	}
+	return c, fuse.OK
+}
+
+func (dir *SearchDir) Rmdir(name string, ctx *fuse.Context) fuse.Status {
+	if err := dir.rmdir(name); err != nil {
+		return fuse.ENOENT
+	}
+	removeChild(dir, name)
+	return fuse.OK
+}
+
 func (dir *TaskDir) Lookup(out *fuse.Attr, name string, ctx *fuse.Context) (*nodefs.Inode, fuse.Status) {
 	return lookupName(dir, name, out, ctx)
 }
 
 func (dir *TaskDir) GetAttr(out *fuse.Attr, file nodefs.File, ctx *fuse.Context) fuse.Status {
-	dir.FileInfo.FillAttr(out)
+	dir.Stat().FillAttr(out)
 	return fuse.OK
 }
 
@@ -92,8 +165,21 @@ func (dir *TaskDir) OpenDir(ctx *fuse.Context) ([]fuse.DirEntry, fuse.Status) {
 	return readDir(dir)
 }
 
+func (c *CommentsDir) Lookup(out *fuse.Attr, name string, ctx *fuse.Context) (*nodefs.Inode, fuse.Status) {
+	return lookupName(c, name, out, ctx)
+}
+
+func (c *CommentsDir) GetAttr(out *fuse.Attr, file nodefs.File, ctx *fuse.Context) fuse.Status {
+	c.Stat().FillAttr(out)
+	return fuse.OK
+}
+
+func (c *CommentsDir) OpenDir(ctx *fuse.Context) ([]fuse.DirEntry, fuse.Status) {
+	return readDir(c)
+}
+
 func (t *Text) GetAttr(out *fuse.Attr, file nodefs.File, ctx *fuse.Context) fuse.Status {
-	t.FileInfo.FillAttr(out)
+	t.Stat().FillAttr(out)
 	return fuse.OK
 }
 
@@ -103,15 +189,132 @@ func (t *Text) OpenDir(ctx *fuse.Context) ([]fuse.DirEntry, fuse.Status) {
 
 func (t *Text) Open(flags uint32, ctx *fuse.Context) (nodefs.File, fuse.Status) {
 	if flags&fuse.O_ANYWRITE != 0 {
-		return nil, fuse.EPERM
+		if !t.Writable() {
+			return nil, fuse.EPERM
+		}
+		return newTextFile(t, flags), fuse.OK
 	}
 	p, err := t.ReadFile()
 	if err != nil {
-		return nil, fuse.EIO
+		return nil, errorStatus(err, fuse.EIO)
 	}
 	return nodefs.NewDataFile(p), fuse.OK
 }
 
+func (t *Text) Truncate(file nodefs.File, size uint64, ctx *fuse.Context) fuse.Status {
+	if file == nil {
+		return fuse.EPERM
+	}
+	return file.Truncate(size)
+}
+
+// textFile holds data written to the Text until the file is closed.
+type textFile struct {
+	nodefs.File
+	t     *Text
+	since time.Time // LastMod of t when the file was opened
+
+	mu    sync.Mutex // protects below
+	data  []byte
+	dirty bool
+}
+
+func newTextFile(t *Text, flags uint32) *textFile {
+	f := &textFile{
+		File:  nodefs.NewDefaultFile(),
+		t:     t,
+		since: t.Stat().LastMod,
+	}
+	if flags&uint32(os.O_TRUNC) != 0 {
+		f.dirty = true
+	} else {
+		p, _ := t.ReadFile()
+		f.data = append([]byte(nil), p...)
+	}
+	return f
+}
+
+func (f *textFile) GetAttr(out *fuse.Attr) fuse.Status {
+	f.t.Stat().FillAttr(out)
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	out.Size = uint64(len(f.data))
+	return fuse.OK
+}
+
+func (f *textFile) Read(buf []byte, off int64) (fuse.ReadResult, fuse.Status) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if off >= int64(len(f.data)) {
+		return fuse.ReadResultData(nil), fuse.OK
+	}
+	end := off + int64(len(buf))
+	if end > int64(len(f.data)) {
+		end = int64(len(f.data))
+	}
+	return fuse.ReadResultData(append([]byte(nil), f.data[off:end]...)), fuse.OK
+}
+
+func (f *textFile) Write(data []byte, off int64) (uint32, fuse.Status) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	end := off + int64(len(data))
+	if end > int64(len(f.data)) {
+		f.data = append(f.data, make([]byte, end-int64(len(f.data)))...)
+	}
+	copy(f.data[off:], data)
+	f.dirty = true
+	return uint32(len(data)), fuse.OK
+}
+
+func (f *textFile) Truncate(size uint64) fuse.Status {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if size > uint64(len(f.data)) {
+		f.data = append(f.data, make([]byte, size-uint64(len(f.data)))...)
+	} else {
+		f.data = f.data[:size]
+	}
+	f.dirty = true
+	return fuse.OK
+}
+
+func (f *textFile) Flush() fuse.Status {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if !f.dirty {
+		return fuse.OK
+	}
+	f.dirty = false
+	if err := f.t.WriteFile(f.data, f.since); err != nil {
+		return errorStatus(err, fuse.EIO)
+	}
+	return fuse.OK
+}
+
+// errorStatus maps err to fuse.Status. Well-known HTTP errors are
+// mapped to specific errno values; others are mapped to def.
+func errorStatus(err error, def fuse.Status) fuse.Status {
+	if err == nil {
+		return fuse.OK
+	}
+	if errors.Is(err, ErrConflict) {
+		return fuse.EBUSY
+	}
+	if errors.Is(err, os.ErrExist) {
+		return fuse.Status(syscall.EEXIST)
+	}
+	switch statusCode(err) {
+	case http.StatusUnauthorized, http.StatusForbidden:
+		return fuse.EACCES
+	case http.StatusNotFound:
+		return fuse.ENOENT
+	case http.StatusTooManyRequests:
+		return fuse.EAGAIN
+	}
+	return def
+}
+
 func (t *CommentText) GetAttr(out *fuse.Attr, file nodefs.File, ctx *fuse.Context) fuse.Status {
 	t.FileInfo.FillAttr(out)
 	return fuse.OK
@@ -127,7 +330,7 @@ func (t *CommentText) Open(flags uint32, ctx *fuse.Context) (nodefs.File, fuse.S
 	}
 	p, err := t.ReadFile()
 	if err != nil {
-		return nil, fuse.EIO
+		return nil, errorStatus(err, fuse.EIO)
 	}
 	return nodefs.NewDataFile(p), fuse.OK
 }
@@ -144,9 +347,13 @@ func (ctl *Ctl) OpenDir(ctx *fuse.Context) ([]fuse.DirEntry, fuse.Status) {
 func (ctl *Ctl) Open(flags uint32, ctx *fuse.Context) (nodefs.File, fuse.Status) {
 	p, err := ctl.ReadFile()
 	if err != nil {
-		return nil, fuse.EIO
+		return nil, errorStatus(err, fuse.EIO)
 	}
-	return nodefs.NewDataFile(p), fuse.OK
+	// ctl reports its size as zero; read it directly.
+	return &nodefs.WithFlags{
+		File:      nodefs.NewDataFile(p),
+		FuseFlags: fuse.FOPEN_DIRECT_IO,
+	}, fuse.OK
 }
 
 func (ctl *Ctl) Truncate(file nodefs.File, size uint64, ctx *fuse.Context) fuse.Status {
@@ -156,11 +363,71 @@ func (ctl *Ctl) Truncate(file nodefs.File, size uint64, ctx *fuse.Context) fuse.
 func (ctl *Ctl) Write(file nodefs.File, data []byte, off int64, ctx *fuse.Context) (uint32, fuse.Status) {
 	err := ctl.WriteFile(data)
 	if err != nil {
-		return 0, fuse.EINVAL
+		return 0, errorStatus(err, fuse.EINVAL)
 	}
 	return uint32(len(data)), fuse.OK
 }
 
+// treeMu serializes modifications of the inode tree; go-fuse doesn't
+// provide a way to add a child only if it is missing.
+var treeMu sync.Mutex
+
+// removeChild removes the inode named name from dir.
+func removeChild(dir Dir, name string) {
+	if dir.Inode() == nil {
+		return
+	}
+	treeMu.Lock()
+	defer treeMu.Unlock()
+	if c := dir.Inode().RmChild(name); c != nil {
+		notifyDelete(dir.Inode(), c, name)
+	}
+}
+
+// reconcile updates the inode tree of dir with its current contents.
+// It is used for changes that are not triggered by the kernel.
+func reconcile(dir Dir) {
+	if dir.Inode() == nil {
+		return
+	}
+	readDir(dir)
+}
+
+// invalidate tells the kernel that data and attributes of d have changed.
+// If d is a directory, the kernel also forgets its entries.
+func invalidate(d Dir) {
+	n := d.Inode()
+	if connector == nil || n == nil {
+		return
+	}
+	go func() {
+		connector.FileNotify(n, 0, 0)
+		if n.IsDir() {
+			for name := range n.Children() {
+				connector.EntryNotify(n, name)
+			}
+		}
+	}()
+}
+
+// notifyDelete tells the kernel that child named name disappeared.
+// The kernel might wait for the request that calls this function,
+// so notifications are sent asynchronously.
+func notifyDelete(parent, child *nodefs.Inode, name string) {
+	if connector == nil {
+		return
+	}
+	go connector.DeleteNotify(parent, child, name)
+}
+
+// notifyEntry tells the kernel to forget the entry name in parent.
+func notifyEntry(parent *nodefs.Inode, name string) {
+	if connector == nil {
+		return
+	}
+	go connector.EntryNotify(parent, name)
+}
+
 func lookupName(dir Dir, name string, out *fuse.Attr, ctx *fuse.Context) (*nodefs.Inode, fuse.Status) {
 	_, status := readDir(dir)
 	if status != fuse.OK {
@@ -181,15 +448,32 @@ func readDir(dir Dir) ([]fuse.DirEntry, fuse.Status) {
 	p := dir.Inode()
 	kids, err := dir.ReadDir()
 	if err != nil {
-		return nil, fuse.EIO
+		return nil, errorStatus(err, fuse.EIO)
 	}
+	treeMu.Lock()
+	defer treeMu.Unlock()
 	a := make([]fuse.DirEntry, len(kids))
+	names := make(map[string]bool, len(kids))
 	for i, kid := range kids {
 		info := kid.Stat()
-		if p.GetChild(info.Name) == nil {
+		names[info.Name] = true
+		c := p.GetChild(info.Name)
+		if c != nil && c.Node() != nodefs.Node(kid) {
+			p.RmChild(info.Name)
+			notifyEntry(p, info.Name)
+			c = nil
+		}
+		if c == nil {
 			p.NewChild(info.Name, info.IsDir(), kid)
 		}
 		info.FillDirEntry(&a[i])
 	}
+	// drop children that disappeared from dir
+	for name, c := range p.Children() {
+		if !names[name] {
+			p.RmChild(name)
+			notifyDelete(p, c, name)
+		}
+	}
 	return a, fuse.OK
 }
@@ -6,7 +6,7 @@ package fs
 import "errors"
 
 type Node interface {
-	MountAndServe(mtpt string, debug bool) error
+	MountAndServe(mtpt string, opts *MountOptions) error
 }
 
 type node struct{}
@@ -15,6 +15,15 @@ func NewNode() Node {
 	return &node{}
 }
 
-func (*node) MountAndServe(mtpt string, debug bool) error {
+func (*node) MountAndServe(mtpt string, opts *MountOptions) error {
 	return errors.New("not implement")
 }
+
+func removeChild(dir Dir, name string) {
+}
+
+func reconcile(dir Dir) {
+}
+
+func invalidate(d Dir) {
+}
@@ -0,0 +1,759 @@
+package fs
+
+import (
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+type stubComment struct {
+	key string
+	msg string
+	t   time.Time
+}
+
+func (c *stubComment) Key() string         { return c.key }
+func (c *stubComment) Message() string     { return c.msg }
+func (c *stubComment) Creation() time.Time { return c.t }
+func (c *stubComment) LastMod() time.Time  { return c.t }
+
+// stubTask is a Task that can change its subject and message, and
+// accepts comments. SetSubject waits until block is closed if it is
+// not nil, then fails with err if set.
+type stubTask struct {
+	key     string
+	subject string
+	message string
+	lastMod time.Time
+	block   chan struct{}
+	err     error
+	loading chan struct{} // Comments waits until it is closed
+	latest  *atomic.Int32 // counts calls of Latest if not nil
+}
+
+func (t *stubTask) Key() string         { return t.key }
+func (t *stubTask) Subject() string     { return t.subject }
+func (t *stubTask) Message() string     { return t.message }
+func (t *stubTask) PermaLink() string   { return "https://example.com/" + t.key }
+func (t *stubTask) State() string       { return StateOpen }
+func (t *stubTask) Creation() time.Time { return t.lastMod }
+func (t *stubTask) LastMod() time.Time  { return t.lastMod }
+
+func (t *stubTask) Comments() ([]Comment, error) {
+	if t.loading != nil {
+		<-t.loading
+	}
+	return []Comment{
+		&stubComment{key: "1", msg: "comment", t: t.lastMod},
+	}, nil
+}
+
+func (t *stubTask) Latest() (time.Time, error) {
+	if t.latest != nil {
+		t.latest.Add(1)
+	}
+	return t.lastMod, nil
+}
+
+func (t *stubTask) SetSubject(s string) error {
+	if t.block != nil {
+		<-t.block
+	}
+	if t.err != nil {
+		return t.err
+	}
+	t.subject = s
+	t.lastMod = t.lastMod.Add(time.Second)
+	return nil
+}
+
+func (t *stubTask) SetMessage(s string) error {
+	t.message = s
+	t.lastMod = t.lastMod.Add(time.Second)
+	return nil
+}
+
+func (t *stubTask) AddComment(s string) error {
+	t.lastMod = t.lastMod.Add(time.Second)
+	return nil
+}
+
+// stubService is a Service that returns new tasks on each List.
+// If err is set, List fails with it. Tasks fail to write with writeErr.
+type stubService struct {
+	name string
+
+	mu       sync.Mutex
+	n        int
+	err      error
+	writeErr error
+	block    chan struct{}
+	loading  chan struct{}
+	listing  chan struct{} // List waits until it is closed
+	listed   chan struct{} // List sends to it before waiting listing
+
+	latest atomic.Int32 // calls of Latest of all tasks
+}
+
+func (s *stubService) Name() string {
+	return s.name
+}
+
+func (s *stubService) List() ([]Task, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.listing != nil {
+		s.listed <- struct{}{}
+		<-s.listing
+	}
+	if s.err != nil {
+		return nil, s.err
+	}
+	s.n++
+	t := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC).Add(time.Duration(s.n) * time.Minute)
+	a := make([]Task, 3)
+	for i := range a {
+		a[i] = &stubTask{
+			key:     fmt.Sprintf("task#%d", i+1),
+			subject: fmt.Sprintf("subject %d", s.n),
+			lastMod: t,
+			block:   s.block,
+			err:     s.writeErr,
+			loading: s.loading,
+			latest:  &s.latest,
+		}
+	}
+	return a, nil
+}
+
+func (s *stubService) setError(err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.err = err
+}
+
+func newTestRoot(t *testing.T, svc Service, args ...string) *Root {
+	t.Helper()
+	root := NewRoot()
+	root.SetCacheDir(t.TempDir())
+	root.RegisterService("stub", func(token, url string, filter *Filter) (Service, error) {
+		return svc, nil
+	})
+	if err := root.addService(append([]string{"stub", "token"}, args...)...); err != nil {
+		t.Fatal(err)
+	}
+	return root
+}
+
+func lookup(t *testing.T, dir Dir, name string) Dir {
+	t.Helper()
+	kids, err := dir.ReadDir()
+	if err != nil {
+		t.Fatalf("ReadDir(%s): %v", dir.Stat().Name, err)
+	}
+	for _, kid := range kids {
+		if kid.Stat().Name == name {
+			return kid
+		}
+	}
+	t.Fatalf("%s is not found in %s", name, dir.Stat().Name)
+	return nil
+}
+
+func TestConcurrentAccess(t *testing.T) {
+	svc := &stubService{name: "stub.example.com"}
+	root := newTestRoot(t, svc)
+	sdir := lookup(t, root, svc.name)
+	ctl := lookup(t, sdir, "ctl").(*Ctl)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 50; j++ {
+				if _, err := root.ReadDir(); err != nil {
+					t.Error(err)
+					return
+				}
+				kids, err := sdir.ReadDir()
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				for _, kid := range kids {
+					kid.Stat()
+					td, ok := kid.(*TaskDir)
+					if !ok {
+						continue
+					}
+					files, err := td.ReadDir()
+					if err != nil {
+						t.Error(err)
+						return
+					}
+					for _, f := range files {
+						f.Stat()
+						if f.Stat().IsDir() {
+							f.ReadDir()
+						} else {
+							f.ReadFile()
+						}
+					}
+				}
+			}
+		}()
+	}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for j := 0; j < 50; j++ {
+			if err := ctl.WriteFile([]byte("refresh\n")); err != nil {
+				t.Error(err)
+				return
+			}
+			if err := root.ctl.WriteFile([]byte("refresh\n")); err != nil {
+				t.Error(err)
+				return
+			}
+		}
+	}()
+	wg.Wait()
+}
+
+func TestStatDuringWrite(t *testing.T) {
+	block := make(chan struct{})
+	svc := &stubService{name: "stub.example.com", block: block}
+	root := newTestRoot(t, svc)
+	sdir := lookup(t, root, svc.name)
+	td := lookup(t, sdir, "task#1")
+	subject := lookup(t, td, "subject").(*Text)
+
+	done := make(chan error, 1)
+	since := subject.Stat().LastMod
+	go func() {
+		done <- subject.WriteFile([]byte("new subject\n"), since)
+	}()
+
+	// the write is blocked in SetSubject; others must not wait for it.
+	stat := make(chan struct{})
+	go func() {
+		defer close(stat)
+		for i := 0; i < 10; i++ {
+			kids, err := sdir.ReadDir()
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			for _, kid := range kids {
+				kid.Stat()
+			}
+			root.ReadDir()
+		}
+	}()
+	select {
+	case <-stat:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Stat is blocked by the write")
+	}
+	close(block)
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	p, _ := subject.ReadFile()
+	if s := string(p); s != "new subject\n" {
+		t.Errorf("subject = %q; want %q", s, "new subject\n")
+	}
+}
+
+func TestEditConflict(t *testing.T) {
+	svc := &stubService{name: "stub.example.com"}
+	root := newTestRoot(t, svc)
+	sdir := lookup(t, root, svc.name)
+	td := lookup(t, sdir, "task#1")
+	subject := lookup(t, td, "subject").(*Text)
+	since := subject.Stat().LastMod
+
+	// the task is updated on the server after the file was opened.
+	sdir.(*ServiceDir).refreshCache()
+	mustReadDir(t, sdir)
+
+	err := subject.WriteFile([]byte("new subject\n"), since)
+	if err != ErrConflict {
+		t.Errorf("WriteFile = %v; want %v", err, ErrConflict)
+	}
+}
+
+func TestSuccessiveEdits(t *testing.T) {
+	svc := &stubService{name: "stub.example.com"}
+	root := newTestRoot(t, svc)
+	sdir := lookup(t, root, svc.name)
+	td := lookup(t, sdir, "task#1")
+	write := func(name, s string) {
+		t.Helper()
+		f := lookup(t, td, name).(*Text)
+		if err := f.WriteFile([]byte(s), f.Stat().LastMod); err != nil {
+			t.Fatalf("write %s: %v", name, err)
+		}
+	}
+	write("subject", "new subject\n")
+	write("message", "new message\n")
+	write("new", "comment\n")
+	write("subject", "next subject\n")
+	if s := readString(t, td, "subject"); s != "next subject\n" {
+		t.Errorf("subject = %q; want %q", s, "next subject\n")
+	}
+}
+
+func mustReadDir(t *testing.T, dir Dir) []Dir {
+	t.Helper()
+	kids, err := dir.ReadDir()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return kids
+}
+
+func readString(t *testing.T, dir Dir, name string) string {
+	t.Helper()
+	p, err := lookup(t, dir, name).ReadFile()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(p)
+}
+
+func TestOfflineFallback(t *testing.T) {
+	svc := &stubService{name: "stub.example.com"}
+	root := newTestRoot(t, svc)
+	sdir := lookup(t, root, svc.name).(*ServiceDir)
+	td := lookup(t, sdir, "task#1")
+	want := readString(t, td, "subject")
+	mustReadDir(t, lookup(t, td, "comments"))
+	if s := readString(t, sdir, "status"); s != "online\n" {
+		t.Errorf("status = %q; want online", s)
+	}
+
+	svc.setError(errOffline)
+	sdir.refreshCache()
+	td = lookup(t, sdir, "task#1")
+	if s := readString(t, td, "subject"); s != want {
+		t.Errorf("subject = %q; want %q", s, want)
+	}
+	if s := readString(t, lookup(t, td, "comments"), "1"); s != "comment" {
+		t.Errorf("comment = %q; want %q", s, "comment")
+	}
+	if s := readString(t, sdir, "status"); !strings.HasPrefix(s, "offline ") {
+		t.Errorf("status = %q; want offline", s)
+	}
+
+	svc.setError(nil)
+	sdir.refreshCache()
+	mustReadDir(t, sdir)
+	if s := readString(t, sdir, "status"); s != "online\n" {
+		t.Errorf("status = %q; want online", s)
+	}
+}
+
+// searchService is a stubService that can search tasks.
+type searchService struct {
+	*stubService
+}
+
+func (s *searchService) Search(expr string) ([]Task, error) {
+	return s.List()
+}
+
+func TestQueryDirOutbox(t *testing.T) {
+	stub := &stubService{name: "stub.example.com"}
+	root := newTestRoot(t, &searchService{stub})
+	sdir := lookup(t, root, stub.name).(*ServiceDir)
+	search := lookup(t, sdir, ".search").(*SearchDir)
+	if err := search.mkdir("is:open"); err != nil {
+		t.Fatal(err)
+	}
+	qdir := lookup(t, search, "is:open")
+	stub.mu.Lock()
+	stub.writeErr = errOffline
+	stub.mu.Unlock()
+	qdir.(*ServiceDir).refreshCache()
+	subject := lookup(t, lookup(t, qdir, "task#1"), "subject").(*Text)
+	if err := subject.WriteFile([]byte("new subject\n"), subject.Stat().LastMod); err != nil {
+		t.Fatal(err)
+	}
+	if s := readString(t, sdir, "pending"); !strings.Contains(s, " task#1 subject ") {
+		t.Errorf("pending = %q; want the subject operation", s)
+	}
+}
+
+func TestReadDuringCommentsLoading(t *testing.T) {
+	loading := make(chan struct{})
+	svc := &stubService{name: "stub.example.com", loading: loading}
+	root := newTestRoot(t, svc)
+	sdir := lookup(t, root, svc.name)
+	td := lookup(t, sdir, "task#1")
+	comments := lookup(t, td, "comments")
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := comments.ReadDir()
+		done <- err
+	}()
+	read := make(chan struct{})
+	go func() {
+		defer close(read)
+		kids, err := sdir.ReadDir()
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		for _, kid := range kids {
+			kid.Stat()
+		}
+		files, err := td.ReadDir()
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		for _, f := range files {
+			if !f.Stat().IsDir() {
+				f.ReadFile()
+			}
+		}
+	}()
+	select {
+	case <-read:
+	case <-time.After(5 * time.Second):
+		t.Fatal("files of the task are blocked by loading comments")
+	}
+	close(loading)
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+}
+
+// treeService is a Service that lists tasks located at paths.
+type treeService struct {
+	name  string
+	paths [][]string
+}
+
+func (s *treeService) Name() string {
+	return s.name
+}
+
+func (s *treeService) List() ([]Task, error) {
+	t := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	a := make([]Task, len(s.paths))
+	for i, path := range s.paths {
+		a[i] = &locatorTask{
+			stubTask: &stubTask{key: strings.Join(path, "/"), subject: "subject", lastMod: t},
+			path:     path,
+		}
+	}
+	return a, nil
+}
+
+type locatorTask struct {
+	*stubTask
+	path []string
+}
+
+func (t *locatorTask) Path() []string {
+	return t.path
+}
+
+func TestTreeLayoutReservedName(t *testing.T) {
+	svc := &treeService{
+		name: "stub.example.com",
+		paths: [][]string{
+			{"ctl", "repo", "1"},
+			{"lufia", "ctl", "2"},
+		},
+	}
+	root := newTestRoot(t, svc, "layout=tree")
+	sdir := lookup(t, root, svc.name)
+	if _, ok := lookup(t, sdir, "ctl").(*Ctl); !ok {
+		t.Errorf("ctl is not a control file")
+	}
+	td := lookup(t, lookup(t, lookup(t, sdir, "@ctl"), "repo"), "1")
+	if s := readString(t, td, "subject"); s != "subject" {
+		t.Errorf("subject = %q; want %q", s, "subject")
+	}
+	// groups other than ones in the service directory are not renamed.
+	lookup(t, lookup(t, lookup(t, sdir, "lufia"), "ctl"), "2")
+}
+
+func TestReadDirDuringLoad(t *testing.T) {
+	svc := &stubService{name: "stub.example.com"}
+	root := newTestRoot(t, svc)
+	sdir := lookup(t, root, svc.name).(*ServiceDir)
+	mustReadDir(t, sdir)
+
+	listing := make(chan struct{})
+	listed := make(chan struct{})
+	svc.mu.Lock()
+	svc.listing = listing
+	svc.listed = listed
+	svc.mu.Unlock()
+	done := make(chan error, 1)
+	go func() {
+		// same as poll
+		sdir.loadMu.Lock()
+		defer sdir.loadMu.Unlock()
+		_, err := sdir.load()
+		done <- err
+	}()
+	<-listed
+
+	read := make(chan struct{})
+	go func() {
+		defer close(read)
+		kids, err := sdir.ReadDir()
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		for _, kid := range kids {
+			kid.Stat()
+		}
+	}()
+	select {
+	case <-read:
+	case <-time.After(5 * time.Second):
+		t.Fatal("ReadDir is blocked by loading in background")
+	}
+	close(listing)
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRootReadDirDuringRefresh(t *testing.T) {
+	svc := &stubService{name: "stub.example.com"}
+	root := newTestRoot(t, svc)
+	sdir := lookup(t, root, svc.name).(*ServiceDir)
+
+	// the service directory is busy, so refresh waits for it.
+	sdir.mu.Lock()
+	done := make(chan error, 1)
+	go func() {
+		done <- root.ctl.WriteFile([]byte("refresh\n"))
+	}()
+	time.Sleep(100 * time.Millisecond)
+
+	read := make(chan error, 1)
+	go func() {
+		_, err := root.ReadDir()
+		read <- err
+	}()
+	select {
+	case err := <-read:
+		if err != nil {
+			t.Error(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Error("ReadDir of the root is blocked by refresh")
+	}
+	sdir.mu.Unlock()
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestFlushSkipsFailedOperations(t *testing.T) {
+	svc := &stubService{name: "stub.example.com", writeErr: errOffline}
+	root := newTestRoot(t, svc)
+	sdir := lookup(t, root, svc.name).(*ServiceDir)
+	subject := lookup(t, lookup(t, sdir, "task#1"), "subject").(*Text)
+	if err := subject.WriteFile([]byte("new subject\n"), subject.Stat().LastMod); err != nil {
+		t.Fatal(err)
+	}
+
+	// the task is updated on the server, so the replay conflicts.
+	svc.mu.Lock()
+	svc.writeErr = nil
+	svc.mu.Unlock()
+	sdir.refreshCache()
+	mustReadDir(t, sdir)
+	if s := readString(t, sdir, "pending"); !strings.Contains(s, " # ") {
+		t.Fatalf("pending = %q; want the operation with an error", s)
+	}
+
+	n := svc.latest.Load()
+	sdir.refreshCache()
+	mustReadDir(t, sdir)
+	if m := svc.latest.Load(); m != n {
+		t.Errorf("failed operation is replayed %d times by loading the list", m-n)
+	}
+	ctl := lookup(t, sdir, "ctl").(*Ctl)
+	if err := ctl.WriteFile([]byte("flush\n")); err != nil {
+		t.Fatal(err)
+	}
+	if m := svc.latest.Load(); m == n {
+		t.Errorf("failed operation is not replayed by flush command")
+	}
+}
+
+func TestDiskCacheConcurrentWrite(t *testing.T) {
+	c := newDiskCache(t.TempDir(), "stub.example.com")
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			a := make([]string, 1000)
+			for j := range a {
+				a[j] = strings.Repeat(fmt.Sprint(i), j%100)
+			}
+			for j := 0; j < 10; j++ {
+				if err := c.write("test.json", a); err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+	var a []string
+	if err := c.read("test.json", &a); err != nil {
+		t.Fatal(err)
+	}
+	if len(a) != 1000 {
+		t.Errorf("len = %d; want 1000", len(a))
+	}
+	files, err := os.ReadDir(c.dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 1 {
+		t.Errorf("files = %v; want only test.json", files)
+	}
+}
+
+func TestScopedServiceInService(t *testing.T) {
+	root := NewRoot()
+	root.RegisterService("stub", func(token, url string, filter *Filter) (Service, error) {
+		name := "stub.example.com"
+		if filter.Project != "" {
+			name += "/" + filter.Project
+		}
+		return &stubService{name: name}, nil
+	})
+	add := func(args ...string) {
+		t.Helper()
+		if err := root.addService(append([]string{"stub", "token"}, args...)...); err != nil {
+			t.Fatal(err)
+		}
+	}
+	remove := func(name string) {
+		t.Helper()
+		if err := root.removeService(name); err != nil {
+			t.Fatal(err)
+		}
+	}
+	add("project=org/repo")
+	if _, ok := lookup(t, root, "stub.example.com").(*PathDir); !ok {
+		t.Errorf("stub.example.com is not a path directory")
+	}
+
+	add()
+	sdir, ok := lookup(t, root, "stub.example.com").(*ServiceDir)
+	if !ok {
+		t.Fatalf("stub.example.com is not a service directory")
+	}
+	lookup(t, sdir, "task#1")
+	repo := lookup(t, lookup(t, sdir, "org"), "repo")
+	if _, ok := repo.(*ServiceDir); !ok {
+		t.Fatalf("org/repo is not a service directory")
+	}
+	lookup(t, repo, "task#1")
+
+	remove("stub.example.com")
+	lookup(t, lookup(t, lookup(t, root, "stub.example.com"), "org"), "repo")
+
+	add()
+	remove("stub.example.com/org/repo")
+	sdir = lookup(t, root, "stub.example.com").(*ServiceDir)
+	for _, kid := range mustReadDir(t, sdir) {
+		if kid.Stat().Name == "org" {
+			t.Errorf("org remains after org/repo is removed")
+		}
+	}
+}
+
+func TestTokenize(t *testing.T) {
+	tests := []struct {
+		line string
+		args []string
+	}{
+		{"github env:GITHUB_TOKEN", []string{"github", "env:GITHUB_TOKEN"}},
+		{"  github\ttoken \r", []string{"github", "token"}},
+		{"github '' https://example.com", []string{"github", "", "https://example.com"}},
+		{"backlog 'cmd:pass show backlog'", []string{"backlog", "cmd:pass show backlog"}},
+		{"gitlab 'it''s' a'b c'd", []string{"gitlab", "it's", "ab cd"}},
+		{"''''", []string{"'"}},
+		{"", nil},
+	}
+	for _, tt := range tests {
+		if a := tokenize(tt.line); !slices.Equal(a, tt.args) {
+			t.Errorf("tokenize(%q) = %q; want %q", tt.line, a, tt.args)
+		}
+	}
+}
+
+func TestQuote(t *testing.T) {
+	tests := [][]string{
+		{"github", "env:GITHUB_TOKEN"},
+		{"github", "", "https://example.com"},
+		{"backlog", "cmd:pass show backlog", "file:/path/to/token"},
+		{"gitlab", "it's", "'", "''", "a\tb"},
+		{"github", "ghp_0123456789", " leading", "trailing "},
+	}
+	for _, args := range tests {
+		a := make([]string, len(args))
+		for i, arg := range args {
+			a[i] = quote(arg)
+		}
+		line := strings.Join(a, " ")
+		if v := tokenize(line); !slices.Equal(v, args) {
+			t.Errorf("tokenize(%q) = %q; want %q", line, v, args)
+		}
+	}
+}
+
+func TestResolveToken(t *testing.T) {
+	t.Setenv("TASKFS_TEST_TOKEN", "env-token")
+	file := t.TempDir() + "/token"
+	if err := os.WriteFile(file, []byte("  file-token\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		s       string
+		want    string
+		wantErr bool
+	}{
+		{"plain-token", "plain-token", false},
+		{"", "", false},
+		{"https://example.com", "https://example.com", false},
+		{"env:TASKFS_TEST_TOKEN", "env-token", false},
+		{"env:TASKFS_TEST_NOTSET", "", true},
+		{"file:" + file, "file-token", false},
+		{"file:" + file + ".notexist", "", true},
+	}
+	for _, tt := range tests {
+		s, err := resolveToken(tt.s)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("resolveToken(%q): err = %v; want error = %t", tt.s, err, tt.wantErr)
+			continue
+		}
+		if s != tt.want {
+			t.Errorf("resolveToken(%q) = %q; want %q", tt.s, s, tt.want)
+		}
+	}
+}
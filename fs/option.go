@@ -0,0 +1,130 @@
+package fs
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// serviceOptions are options of a service given as name=value arguments
+// to add command.
+type serviceOptions struct {
+	ttl      time.Duration // lifetime of the task list; 0 means forever
+	taskTTL  time.Duration // lifetime of comments of tasks
+	poll     time.Duration // interval of background refresh; 0 disables it
+	prefetch int           // number of workers to prefetch comments; 0 disables it
+	layout   string        // layoutFlat or layoutTree
+	filter   Filter
+}
+
+// Layouts of a service directory.
+const (
+	layoutFlat = "flat" // tasks are placed in the service directory by their keys
+	layoutTree = "tree" // tasks are placed in owner/repo/number directories
+)
+
+// isOption reports whether s is formatted as name=value.
+func isOption(s string) bool {
+	i := strings.IndexByte(s, '=')
+	if i <= 0 {
+		return false
+	}
+	for _, c := range s[:i] {
+		if c < 'a' || c > 'z' {
+			return false
+		}
+	}
+	return true
+}
+
+func parseOptions(a []string) (*serviceOptions, error) {
+	opts := serviceOptions{layout: layoutFlat}
+	taskTTL := time.Duration(-1)
+	for _, s := range a {
+		name, value, _ := strings.Cut(s, "=")
+		switch name {
+		case "prefetch":
+			n, err := strconv.Atoi(value)
+			if err != nil {
+				return nil, err
+			}
+			if n < 0 {
+				return nil, errors.New("prefetch must not be negative")
+			}
+			opts.prefetch = n
+			continue
+		case "layout":
+			if value != layoutFlat && value != layoutTree {
+				return nil, errors.New("unknown layout: " + value)
+			}
+			opts.layout = value
+			continue
+		case "filter", "state", "labels", "project", "repo", "since":
+			if err := opts.filter.set(name, value); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		var p *time.Duration
+		switch name {
+		case "ttl":
+			p = &opts.ttl
+		case "taskttl":
+			p = &taskTTL
+		case "poll":
+			p = &opts.poll
+		default:
+			return nil, errors.New("unknown option: " + name)
+		}
+		d, err := time.ParseDuration(value)
+		if err != nil {
+			return nil, err
+		}
+		*p = d
+	}
+	opts.taskTTL = taskTTL
+	if taskTTL < 0 {
+		opts.taskTTL = opts.ttl
+	}
+	return &opts, nil
+}
+
+// set sets the filter name to value.
+func (f *Filter) set(name, value string) error {
+	switch name {
+	case "filter":
+		switch value {
+		case "assigned", "created", "mentioned", "all":
+		default:
+			return errors.New("invalid filter: " + value)
+		}
+		f.Filter = value
+	case "state":
+		switch value {
+		case StateOpen, StateClosed, "all":
+		default:
+			return errors.New("invalid state: " + value)
+		}
+		f.State = value
+	case "labels":
+		f.Labels = nil
+		for _, s := range strings.Split(value, ",") {
+			if s = strings.TrimSpace(s); s != "" {
+				f.Labels = append(f.Labels, s)
+			}
+		}
+	case "project", "repo":
+		f.Project = value
+	case "since":
+		t, err := time.Parse("2006-01-02", value)
+		if err != nil {
+			t, err = time.Parse(time.RFC3339, value)
+		}
+		if err != nil {
+			return errors.New("invalid since: " + value)
+		}
+		f.Since = t
+	}
+	return nil
+}
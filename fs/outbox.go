@@ -0,0 +1,195 @@
+package fs
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Kinds of operations.
+const (
+	opCreate          = "create"
+	opComment         = "comment"
+	opSubject         = "subject"
+	opMessage         = "message"
+	opState           = "state"
+	opAddLabels       = "label+"
+	opRemoveLabels    = "label-"
+	opAddAssignees    = "assignee+"
+	opRemoveAssignees = "assignee-"
+)
+
+// operation is a write operation to a task.
+type operation struct {
+	ID    int
+	Time  time.Time
+	Key   string // key of the task; empty for create
+	Op    string
+	Args  []string
+	Since time.Time // LastMod of the task when it is opened
+	Err   string    `json:",omitempty"` // last error on replay
+}
+
+var errUnsupported = errors.New("operation is not supported")
+
+// apply performs op to task.
+func (op *operation) apply(task Task) error {
+	switch op.Op {
+	case opComment:
+		if c, ok := task.(Commenter); ok {
+			return c.AddComment(op.Args[0])
+		}
+	case opSubject, opMessage:
+		e, ok := task.(Editor)
+		if !ok {
+			break
+		}
+		latest, err := e.Latest()
+		if err != nil {
+			return err
+		}
+		if latest.After(op.Since) {
+			return ErrConflict
+		}
+		if op.Op == opSubject {
+			return e.SetSubject(op.Args[0])
+		}
+		return e.SetMessage(op.Args[0])
+	case opState:
+		if c, ok := task.(StateChanger); ok {
+			return c.SetState(op.Args[0])
+		}
+	case opAddLabels, opRemoveLabels:
+		l, ok := task.(Labeler)
+		if !ok {
+			break
+		}
+		if op.Op == opAddLabels {
+			return l.AddLabels(op.Args)
+		}
+		return l.RemoveLabels(op.Args)
+	case opAddAssignees, opRemoveAssignees:
+		a, ok := task.(Assigner)
+		if !ok {
+			break
+		}
+		if op.Op == opAddAssignees {
+			return a.AddAssignees(op.Args)
+		}
+		return a.RemoveAssignees(op.Args)
+	}
+	return errUnsupported
+}
+
+// isNetworkError reports whether err is caused by the network,
+// rather than rejected by the service.
+func isNetworkError(err error) bool {
+	var e net.Error
+	return errors.As(err, &e)
+}
+
+// outbox holds operations that failed because the service was
+// unreachable. They are stored in diskCache if it is available.
+type outbox struct {
+	store *diskCache
+	file  *Text // pending file
+
+	mu   sync.Mutex
+	ops  []*operation
+	next int
+}
+
+func newOutbox(store *diskCache, file *Text) *outbox {
+	o := &outbox{
+		store: store,
+		file:  file,
+		next:  1,
+	}
+	if store != nil {
+		store.read("outbox.json", &o.ops)
+	}
+	for _, op := range o.ops {
+		if op.ID >= o.next {
+			o.next = op.ID + 1
+		}
+	}
+	o.changed()
+	return o
+}
+
+func (o *outbox) add(op *operation) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	op.ID = o.next
+	op.Time = time.Now()
+	o.next++
+	o.ops = append(o.ops, op)
+	o.changed()
+}
+
+// list returns a snapshot of queued operations.
+func (o *outbox) list() []*operation {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return append([]*operation(nil), o.ops...)
+}
+
+func (o *outbox) remove(id int) error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	for i, op := range o.ops {
+		if op.ID == id {
+			o.ops = append(o.ops[:i:i], o.ops[i+1:]...)
+			o.changed()
+			return nil
+		}
+	}
+	return fmt.Errorf("operation %d not found", id)
+}
+
+func (o *outbox) fail(id int, err error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	for _, op := range o.ops {
+		if op.ID == id {
+			op.Err = err.Error()
+		}
+	}
+	o.changed()
+}
+
+// changed saves operations and updates the pending file.
+// It must be called while holding o.mu.
+func (o *outbox) changed() {
+	if o.store != nil {
+		o.store.write("outbox.json", o.ops)
+	}
+	var b strings.Builder
+	for _, op := range o.ops {
+		fmt.Fprintf(&b, "%d %s %s %s", op.ID, op.Time.Format(time.RFC3339), quote(op.Key), op.Op)
+		for _, arg := range op.Args {
+			fmt.Fprintf(&b, " %s", quote(arg))
+		}
+		if op.Err != "" {
+			fmt.Fprintf(&b, " # %s", op.Err)
+		}
+		b.WriteByte('\n')
+	}
+	o.file.set([]byte(b.String()), time.Now())
+	invalidate(o.file)
+}
+
+func (o *outbox) drop(args ...string) error {
+	if len(args) != 1 {
+		return errors.New("invalid drop command")
+	}
+	id, err := strconv.Atoi(args[0])
+	if err != nil {
+		return err
+	}
+	return o.remove(id)
+}
@@ -0,0 +1,177 @@
+package fs
+
+import (
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Searcher is implemented by a Service that can search tasks with
+// an expression written in its own syntax.
+type Searcher interface {
+	Search(expr string) ([]Task, error)
+}
+
+// query is a Service that lists tasks found by expr.
+type query struct {
+	s    Searcher
+	expr string
+}
+
+func (q *query) Name() string {
+	return q.expr
+}
+
+func (q *query) List() ([]Task, error) {
+	return q.s.Search(q.expr)
+}
+
+// SearchDir is .search directory of a service. Making a directory in it
+// creates a query directory that lists tasks found by its name.
+type SearchDir struct {
+	Node
+	FileInfo
+	svc   *ServiceDir
+	store *diskCache
+
+	mu      sync.Mutex // protects below
+	queries map[string]*ServiceDir
+}
+
+func newSearchDir(svc *ServiceDir, store *diskCache) *SearchDir {
+	now := time.Now()
+	dir := &SearchDir{
+		Node: NewNode(),
+		FileInfo: FileInfo{
+			Name:     ".search",
+			Mode:     os.ModeDir | 0755,
+			Creation: now,
+			LastMod:  now,
+		},
+		svc:     svc,
+		store:   store,
+		queries: make(map[string]*ServiceDir),
+	}
+	var a []string
+	if store != nil {
+		store.read("queries.json", &a)
+	}
+	for _, expr := range a {
+		dir.queries[expr] = dir.newQueryDir(expr)
+	}
+	return dir
+}
+
+// newQueryDir returns a directory that behaves like ServiceDir except
+// it lists tasks found by expr. Its tasks are not stored in the disk,
+// but writes to them are queued into the outbox of the service.
+func (dir *SearchDir) newQueryDir(expr string) *ServiceDir {
+	q := &query{s: dir.svc.svc.(Searcher), expr: expr}
+	return newServiceDir(q, dir.svc.opts, nil, dir.svc)
+}
+
+func (dir *SearchDir) Stat() *FileInfo {
+	return &dir.FileInfo
+}
+
+func (dir *SearchDir) ReadDir() ([]Dir, error) {
+	dir.mu.Lock()
+	defer dir.mu.Unlock()
+	names := make([]string, 0, len(dir.queries))
+	for expr := range dir.queries {
+		names = append(names, expr)
+	}
+	sort.Strings(names)
+	dirs := make([]Dir, len(names))
+	for i, expr := range names {
+		dirs[i] = dir.queries[expr]
+	}
+	return dirs, nil
+}
+
+func (*SearchDir) ReadFile() ([]byte, error) {
+	return nil, errProtocol
+}
+
+// mkdir creates a query directory for expr.
+func (dir *SearchDir) mkdir(expr string) error {
+	dir.mu.Lock()
+	defer dir.mu.Unlock()
+	if _, ok := dir.queries[expr]; ok {
+		return os.ErrExist
+	}
+	q := dir.newQueryDir(expr)
+	dir.queries[expr] = q
+	q.start()
+	dir.save()
+	return nil
+}
+
+// rmdir removes the query directory for expr.
+func (dir *SearchDir) rmdir(expr string) error {
+	dir.mu.Lock()
+	defer dir.mu.Unlock()
+	q, ok := dir.queries[expr]
+	if !ok {
+		return os.ErrNotExist
+	}
+	q.stop()
+	delete(dir.queries, expr)
+	dir.save()
+	return nil
+}
+
+// save writes expressions of queries to the disk.
+// It must be called while holding dir.mu.
+func (dir *SearchDir) save() {
+	if dir.store == nil {
+		return
+	}
+	a := make([]string, 0, len(dir.queries))
+	for expr := range dir.queries {
+		a = append(a, expr)
+	}
+	sort.Strings(a)
+	dir.store.write("queries.json", a)
+}
+
+func (dir *SearchDir) start() {
+	dir.mu.Lock()
+	defer dir.mu.Unlock()
+	for _, q := range dir.queries {
+		q.start()
+	}
+}
+
+func (dir *SearchDir) stop() {
+	dir.mu.Lock()
+	defer dir.mu.Unlock()
+	for _, q := range dir.queries {
+		q.stop()
+	}
+}
+
+// lookupTask returns the TaskDir of key found by queries.
+func (dir *SearchDir) lookupTask(key string) *TaskDir {
+	dir.mu.Lock()
+	defer dir.mu.Unlock()
+	for _, q := range dir.queries {
+		q.mu.Lock()
+		td := q.tasks[key]
+		q.mu.Unlock()
+		if td != nil {
+			return td
+		}
+	}
+	return nil
+}
+
+// refresh invalidates results of all queries.
+func (dir *SearchDir) refresh() {
+	dir.mu.Lock()
+	defer dir.mu.Unlock()
+	for _, q := range dir.queries {
+		q.refreshCache()
+	}
+}
@@ -0,0 +1,60 @@
+package fs
+
+import (
+	"errors"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+// resolveToken returns the token referred by s. The reference is one of:
+//
+//	env:NAME	value of the environment variable NAME
+//	file:PATH	content of the file PATH
+//	cmd:COMMAND	output of COMMAND run by sh -c
+//
+// Other strings are returned as is.
+func resolveToken(s string) (string, error) {
+	if !isTokenRef(s) {
+		return s, nil
+	}
+	kind, ref, _ := strings.Cut(s, ":")
+	switch kind {
+	case "env":
+		v, ok := os.LookupEnv(ref)
+		if !ok {
+			return "", errors.New("environment variable is not set: " + ref)
+		}
+		return v, nil
+	case "file":
+		b, err := os.ReadFile(ref)
+		if err != nil {
+			return "", err
+		}
+		return strings.TrimSpace(string(b)), nil
+	case "cmd":
+		cmd := exec.Command("sh", "-c", ref)
+		cmd.Stderr = os.Stderr
+		b, err := cmd.Output()
+		if err != nil {
+			return "", err
+		}
+		return strings.TrimSpace(string(b)), nil
+	default:
+		return s, nil
+	}
+}
+
+// isTokenRef reports whether s is a reference to the token.
+func isTokenRef(s string) bool {
+	kind, _, ok := strings.Cut(s, ":")
+	if !ok {
+		return false
+	}
+	switch kind {
+	case "env", "file", "cmd":
+		return true
+	default:
+		return false
+	}
+}
@@ -2,13 +2,20 @@ package github
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"net/http"
 	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/google/go-github/v74/github"
 	"github.com/lufia/taskfs/fs"
+	"github.com/lufia/taskfs/httpcache"
+	"github.com/lufia/taskfs/ratelimit"
 	"golang.org/x/oauth2"
 )
 
@@ -51,6 +58,11 @@ func (p *Issue) Key() string {
 	return fmt.Sprintf("%s@%s#%d", repo, owner, p.Number())
 }
 
+// Path returns the owner, the repository and the number of the issue.
+func (p *Issue) Path() []string {
+	return []string{p.repositoryOwner(), p.repositoryName(), strconv.Itoa(p.Number())}
+}
+
 func (p *Issue) Subject() string {
 	return *p.issue.Title
 }
@@ -63,6 +75,39 @@ func (p *Issue) PermaLink() string {
 	return *p.issue.HTMLURL
 }
 
+func (p *Issue) State() string {
+	return p.issue.GetState()
+}
+
+func (p *Issue) Labels() []string {
+	a := make([]string, len(p.issue.Labels))
+	for i, l := range p.issue.Labels {
+		a[i] = l.GetName()
+	}
+	return a
+}
+
+func (p *Issue) Assignees() []string {
+	a := make([]string, len(p.issue.Assignees))
+	for i, u := range p.issue.Assignees {
+		a[i] = u.GetLogin()
+	}
+	return a
+}
+
+func (p *Issue) Author() string {
+	return p.issue.GetUser().GetLogin()
+}
+
+func (p *Issue) Milestone() string {
+	return p.issue.GetMilestone().GetTitle()
+}
+
+// Due returns zero time because GitHub issues don't have due dates.
+func (p *Issue) Due() time.Time {
+	return time.Time{}
+}
+
 func (p *Issue) Creation() time.Time {
 	return p.issue.CreatedAt.Time
 }
@@ -92,6 +137,145 @@ func (p *Issue) Comments() (a []fs.Comment, err error) {
 	return a, nil
 }
 
+func (p *Issue) AddComment(body string) error {
+	ctx := context.Background()
+	owner := p.repositoryOwner()
+	repo := p.repositoryName()
+	comment := &github.IssueComment{
+		Body: github.Ptr(body),
+	}
+	v, _, err := p.svc.c.Issues.CreateComment(ctx, owner, repo, p.Number(), comment)
+	if err != nil {
+		return wrapError(err)
+	}
+	// posting a comment updates the issue
+	if v.UpdatedAt != nil {
+		issue := *p.issue
+		issue.UpdatedAt = v.UpdatedAt
+		p.issue = &issue
+	}
+	return nil
+}
+
+func (p *Issue) Latest() (time.Time, error) {
+	ctx := context.Background()
+	owner := p.repositoryOwner()
+	repo := p.repositoryName()
+	v, _, err := p.svc.c.Issues.Get(ctx, owner, repo, p.Number())
+	if err != nil {
+		return time.Time{}, wrapError(err)
+	}
+	return v.UpdatedAt.Time, nil
+}
+
+func (p *Issue) SetSubject(s string) error {
+	return p.edit(&github.IssueRequest{Title: github.Ptr(s)})
+}
+
+func (p *Issue) SetMessage(s string) error {
+	return p.edit(&github.IssueRequest{Body: github.Ptr(s)})
+}
+
+func (p *Issue) AddLabels(a []string) error {
+	ctx := context.Background()
+	owner := p.repositoryOwner()
+	repo := p.repositoryName()
+	_, _, err := p.svc.c.Issues.AddLabelsToIssue(ctx, owner, repo, p.Number(), a)
+	if err != nil {
+		return wrapError(err)
+	}
+	return p.reload()
+}
+
+func (p *Issue) RemoveLabels(a []string) error {
+	ctx := context.Background()
+	owner := p.repositoryOwner()
+	repo := p.repositoryName()
+	for _, name := range a {
+		_, err := p.svc.c.Issues.RemoveLabelForIssue(ctx, owner, repo, p.Number(), name)
+		if err != nil {
+			return wrapError(err)
+		}
+		// the slice might be shared with the Service
+		var labels []*github.Label
+		for _, l := range p.issue.Labels {
+			if l.GetName() != name {
+				labels = append(labels, l)
+			}
+		}
+		p.issue.Labels = labels
+	}
+	return p.reload()
+}
+
+func (p *Issue) AddAssignees(a []string) error {
+	ctx := context.Background()
+	owner := p.repositoryOwner()
+	repo := p.repositoryName()
+	v, _, err := p.svc.c.Issues.AddAssignees(ctx, owner, repo, p.Number(), a)
+	if err != nil {
+		return wrapError(err)
+	}
+	p.update(v)
+	return nil
+}
+
+func (p *Issue) RemoveAssignees(a []string) error {
+	ctx := context.Background()
+	owner := p.repositoryOwner()
+	repo := p.repositoryName()
+	v, _, err := p.svc.c.Issues.RemoveAssignees(ctx, owner, repo, p.Number(), a)
+	if err != nil {
+		return wrapError(err)
+	}
+	p.update(v)
+	return nil
+}
+
+func (p *Issue) SetState(state string) error {
+	switch state {
+	case fs.StateOpen, fs.StateClosed:
+		return p.edit(&github.IssueRequest{State: github.Ptr(state)})
+	default:
+		return errUnknownState
+	}
+}
+
+func (p *Issue) edit(req *github.IssueRequest) error {
+	ctx := context.Background()
+	owner := p.repositoryOwner()
+	repo := p.repositoryName()
+	v, _, err := p.svc.c.Issues.Edit(ctx, owner, repo, p.Number(), req)
+	if err != nil {
+		return wrapError(err)
+	}
+	p.update(v)
+	return nil
+}
+
+// reload fetches the issue again. The responses of labels don't contain
+// the issue, that has the update time changed by them.
+func (p *Issue) reload() error {
+	ctx := context.Background()
+	owner := p.repositoryOwner()
+	repo := p.repositoryName()
+	v, _, err := p.svc.c.Issues.Get(ctx, owner, repo, p.Number())
+	if err != nil {
+		return wrapError(err)
+	}
+	p.update(v)
+	return nil
+}
+
+// update replaces the issue with v that is returned from the API.
+// The response of a single issue doesn't contain its repository.
+func (p *Issue) update(v *github.Issue) {
+	if v.Repository == nil {
+		v.Repository = p.issue.Repository
+	}
+	p.issue = v
+}
+
 func (p *Issue) repositoryOwner() string {
 	owner := *p.issue.Repository.Owner.Login
 	if org := p.issue.Repository.Organization; org != nil {
@@ -117,38 +301,69 @@ func (p *Issue) fetchComments(page int) ([]*github.IssueComment, int, error) {
 	opt.Page = page
 	b, resp, err := p.svc.c.Issues.ListComments(ctx, owner, repo, n, &opt)
 	if err != nil {
-		return nil, 0, err
+		return nil, 0, wrapError(err)
 	}
 	return b, resp.NextPage, nil
 }
 
+// wrapError wraps err returned from the API with fs.HTTPError.
+// Exceeding rate limits is reported as 429 even if GitHub responds 403.
+func wrapError(err error) error {
+	var e *github.ErrorResponse
+	var rerr *github.RateLimitError
+	var aerr *github.AbuseRateLimitError
+	var xerr *ratelimit.ExceededError
+	switch {
+	case errors.As(err, &rerr), errors.As(err, &aerr), errors.As(err, &xerr):
+		return &fs.HTTPError{StatusCode: http.StatusTooManyRequests, Err: err}
+	case errors.As(err, &e) && e.Response != nil:
+		return &fs.HTTPError{StatusCode: e.Response.StatusCode, Err: err}
+	}
+	return err
+}
+
 type Config struct {
 	BaseURL string
 	Token   string
+	Filter  *fs.Filter // optional
 }
 
-func (c *Config) authorizedClient() *http.Client {
+// authorizedClient returns a client that sends requests through t.
+func (c *Config) authorizedClient(t http.RoundTripper) *http.Client {
 	if c.Token == "" {
-		return nil
+		return &http.Client{Transport: t}
 	}
 	token := &oauth2.Token{
 		AccessToken: c.Token,
 	}
-	s := oauth2.StaticTokenSource(token)
-	return oauth2.NewClient(oauth2.NoContext, s)
+	return &http.Client{
+		Transport: &oauth2.Transport{
+			Source: oauth2.StaticTokenSource(token),
+			Base:   t,
+		},
+	}
 }
 
 type Service struct {
-	c    *github.Client
-	name string
+	c      *github.Client
+	t      *ratelimit.Transport
+	name   string
+	filter fs.Filter
+
+	mu     sync.Mutex // protects below
+	issues map[string]*github.Issue
+	since  time.Time // last update time of issues
+	login  string    // login name of the user; empty until needed
 }
 
+var (
+	errInvalidRepo  = errors.New("repo must be owner/name")
+	errUnknownState = errors.New("unknown state")
+)
+
 func NewService(config *Config) (*Service, error) {
-	var client *http.Client
-	if config.Token != "" {
-		client = config.authorizedClient()
-	}
-	c := github.NewClient(client)
+	t := ratelimit.NewTransport(nil)
+	c := github.NewClient(config.authorizedClient(httpcache.NewTransport(t)))
 	name := "github.com"
 	if config.BaseURL != "" {
 		u, err := url.Parse(config.BaseURL)
@@ -158,23 +373,180 @@ func NewService(config *Config) (*Service, error) {
 		c.BaseURL = u
 		name = u.Host
 	}
-	return &Service{c: c, name: name}, nil
+	t.Resource = apiResource(c.BaseURL.Path)
+	svc := &Service{c: c, t: t, name: name}
+	if config.Filter != nil {
+		svc.filter = *config.Filter
+	}
+	if proj := svc.filter.Project; proj != "" {
+		owner, repo, ok := strings.Cut(proj, "/")
+		if !ok || owner == "" || repo == "" {
+			return nil, errInvalidRepo
+		}
+	}
+	return svc, nil
+}
+
+// apiResource returns a function that returns the resource of rate
+// limits used by the request to the API at base, such as "/api/v3/".
+// Search APIs and GraphQL have their own quotas apart from core.
+func apiResource(base string) func(req *http.Request) string {
+	return func(req *http.Request) string {
+		p, ok := strings.CutPrefix(req.URL.Path, base)
+		switch {
+		case !ok:
+			return "core"
+		case strings.HasPrefix(p, "search/code"):
+			return "code_search"
+		case strings.HasPrefix(p, "search/"):
+			return "search"
+		case p == "graphql":
+			return "graphql"
+		}
+		return "core"
+	}
 }
 
+// Name returns the host name of the service. If the service is limited
+// to a repository, it is appended to the host such as host/owner/repo.
 func (p *Service) Name() string {
+	if p.filter.Project != "" {
+		return p.name + "/" + p.filter.Project
+	}
 	return p.name
 }
 
+func (p *Service) RateLimit() []fs.RateLimit {
+	quotas := p.t.RateLimit()
+	a := make([]fs.RateLimit, len(quotas))
+	for i, q := range quotas {
+		a[i] = fs.RateLimit{
+			Resource:  q.Resource,
+			Limit:     q.Limit,
+			Remaining: q.Remaining,
+			Reset:     q.Reset,
+		}
+	}
+	return a
+}
+
+// List returns issues selected by the filter; by default, open issues
+// assigned to the user. After the first call, it fetches only issues
+// updated since the last call and merges them. Issues that no longer
+// match the filter except for the state remain until Invalidate is called.
 func (p *Service) List() ([]fs.Task, error) {
-	var a []fs.Task
-	var opt github.IssueListOptions
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	state := p.filter.State
+	since := p.filter.Since
+	if !p.since.IsZero() {
+		// closed issues are needed to remove them
+		state = "all"
+		since = p.since
+	}
+	var a []*github.Issue
+	var err error
+	if p.filter.Project != "" {
+		a, err = p.listByRepo(state, since)
+	} else {
+		a, err = p.list(state, since)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if p.since.IsZero() {
+		p.issues = make(map[string]*github.Issue)
+	}
+	for _, v := range a {
+		key := (&Issue{issue: v}).Key()
+		if p.match(v) {
+			p.issues[key] = v
+		} else {
+			delete(p.issues, key)
+		}
+		if t := v.GetUpdatedAt().Time; t.After(p.since) {
+			p.since = t
+		}
+	}
+	return p.tasks(), nil
+}
+
+// match reports whether the state of v matches the filter.
+func (p *Service) match(v *github.Issue) bool {
+	switch p.filter.State {
+	case "all":
+		return true
+	case "":
+		return v.GetState() == fs.StateOpen
+	default:
+		return v.GetState() == p.filter.State
+	}
+}
+
+// list returns issues across repositories that the user can access.
+func (p *Service) list(state string, since time.Time) ([]*github.Issue, error) {
+	opt := github.IssueListOptions{
+		Filter: p.filter.Filter,
+		State:  state,
+		Labels: p.filter.Labels,
+		Since:  since,
+	}
+	var a []*github.Issue
 	ctx := context.Background()
 	for {
 		b, resp, err := p.c.Issues.List(ctx, true, &opt)
+		if err != nil {
+			return nil, wrapError(err)
+		}
+		a = append(a, b...)
+		if resp.NextPage == 0 {
+			break
+		}
+		opt.ListOptions.Page = resp.NextPage
+	}
+	return a, nil
+}
+
+// listByRepo returns issues of the repository specified by the project
+// filter. Unlike list, it returns issues of all users by default.
+func (p *Service) listByRepo(state string, since time.Time) ([]*github.Issue, error) {
+	owner, repo, _ := strings.Cut(p.filter.Project, "/")
+	opt := github.IssueListByRepoOptions{
+		State:  state,
+		Labels: p.filter.Labels,
+		Since:  since,
+	}
+	if f := p.filter.Filter; f != "" && f != "all" {
+		login, err := p.user()
 		if err != nil {
 			return nil, err
 		}
-		a = p.appendIssues(a, b)
+		switch f {
+		case "assigned":
+			opt.Assignee = login
+		case "created":
+			opt.Creator = login
+		case "mentioned":
+			opt.Mentioned = login
+		}
+	}
+	var a []*github.Issue
+	ctx := context.Background()
+	for {
+		b, resp, err := p.c.Issues.ListByRepo(ctx, owner, repo, &opt)
+		if err != nil {
+			return nil, wrapError(err)
+		}
+		for _, v := range b {
+			// issues of a repository don't contain their repository
+			if v.Repository == nil {
+				v.Repository = &github.Repository{
+					Name:  github.Ptr(repo),
+					Owner: &github.User{Login: github.Ptr(owner)},
+				}
+			}
+		}
+		a = append(a, b...)
 		if resp.NextPage == 0 {
 			break
 		}
@@ -183,9 +555,132 @@ func (p *Service) List() ([]fs.Task, error) {
 	return a, nil
 }
 
-func (p *Service) appendIssues(a []fs.Task, b []*github.Issue) []fs.Task {
-	for _, v := range b {
-		a = append(a, &Issue{issue: v, svc: p})
+// user returns the login name of the authenticated user.
+// It must be called while holding p.mu.
+func (p *Service) user() (string, error) {
+	if p.login != "" {
+		return p.login, nil
+	}
+	u, _, err := p.c.Users.Get(context.Background(), "")
+	if err != nil {
+		return "", wrapError(err)
+	}
+	p.login = u.GetLogin()
+	return p.login, nil
+}
+
+// Search returns issues found by expr written in the syntax of GitHub
+// search. Pull requests are excluded unless expr specifies them, and
+// the search is limited to the repository if the service has it.
+func (p *Service) Search(expr string) ([]fs.Task, error) {
+	q := expr
+	if !hasQualifier(q, "is:issue", "is:pr", "is:pull-request", "type:issue", "type:pr") {
+		q += " is:issue"
 	}
+	if p.filter.Project != "" {
+		q += " repo:" + p.filter.Project
+	}
+	opt := &github.SearchOptions{
+		ListOptions: github.ListOptions{PerPage: 100},
+	}
+	var a []fs.Task
+	ctx := context.Background()
+	for {
+		result, resp, err := p.c.Search.Issues(ctx, q, opt)
+		if err != nil {
+			return nil, wrapError(err)
+		}
+		for _, v := range result.Issues {
+			// issues found by search don't contain their repository
+			if v.Repository == nil {
+				owner, repo := splitRepositoryURL(v.GetRepositoryURL())
+				v.Repository = &github.Repository{
+					Name:  github.Ptr(repo),
+					Owner: &github.User{Login: github.Ptr(owner)},
+				}
+			}
+			a = append(a, &Issue{issue: v, svc: p})
+		}
+		if resp.NextPage == 0 {
+			break
+		}
+		opt.ListOptions.Page = resp.NextPage
+	}
+	return a, nil
+}
+
+// hasQualifier reports whether q contains any of qualifiers.
+func hasQualifier(q string, qualifiers ...string) bool {
+	for _, s := range strings.Fields(q) {
+		for _, qualifier := range qualifiers {
+			if strings.EqualFold(s, qualifier) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// splitRepositoryURL returns the owner and the name of the repository
+// from its API URL such as https://api.github.com/repos/owner/name.
+func splitRepositoryURL(s string) (owner, repo string) {
+	s = strings.TrimSuffix(s, "/")
+	i := strings.LastIndexByte(s, '/')
+	if i < 0 {
+		return "", s
+	}
+	s, repo = s[:i], s[i+1:]
+	return s[strings.LastIndexByte(s, '/')+1:], repo
+}
+
+// Invalidate makes next List fetch all issues.
+func (p *Service) Invalidate() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.since = time.Time{}
+}
+
+// tasks returns issues ordered by creation time, newest first.
+// Each task has its own copy of the issue because tasks modify it.
+// It must be called while holding p.mu.
+func (p *Service) tasks() []fs.Task {
+	a := make([]fs.Task, 0, len(p.issues))
+	for _, v := range p.issues {
+		issue := *v
+		a = append(a, &Issue{issue: &issue, svc: p})
+	}
+	sort.Slice(a, func(i, j int) bool {
+		return a[i].Creation().After(a[j].Creation())
+	})
 	return a
 }
+
+// Create creates an issue into the repository specified by params["repo"].
+// It must be formatted as "owner/name". The repository of the service
+// is used if it is omitted.
+func (p *Service) Create(params map[string]string, subject, message string) (fs.Task, error) {
+	repoName := params["repo"]
+	if repoName == "" {
+		repoName = p.filter.Project
+	}
+	owner, repo, ok := strings.Cut(repoName, "/")
+	if !ok || owner == "" || repo == "" {
+		return nil, errInvalidRepo
+	}
+	ctx := context.Background()
+	req := &github.IssueRequest{
+		Title: github.Ptr(subject),
+		Body:  github.Ptr(message),
+	}
+	v, _, err := p.c.Issues.Create(ctx, owner, repo, req)
+	if err != nil {
+		return nil, wrapError(err)
+	}
+	if v.Repository == nil {
+		v.Repository = &github.Repository{
+			Name:  github.Ptr(repo),
+			Owner: &github.User{Login: github.Ptr(owner)},
+		}
+	}
+	return &Issue{issue: v, svc: p}, nil
+}
@@ -1,11 +1,19 @@
 package gitlab
 
 import (
+	"errors"
 	"fmt"
+	"net/http"
 	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/lufia/taskfs/fs"
+	"github.com/lufia/taskfs/httpcache"
+	"github.com/lufia/taskfs/ratelimit"
 	"github.com/xanzy/go-gitlab"
 )
 
@@ -42,6 +50,13 @@ func (p *Issue) Key() string {
 	return fmt.Sprintf("%s@%s#%d", owner, repo, p.issue.IID)
 }
 
+// Path returns elements of the full path of the project, that contains
+// all of its parent groups, and the IID of the issue.
+func (p *Issue) Path() []string {
+	a := strings.Split(p.proj.PathWithNamespace, "/")
+	return append(a, strconv.Itoa(p.issue.IID))
+}
+
 func (p *Issue) Subject() string {
 	return p.issue.Title
 }
@@ -54,6 +69,47 @@ func (p *Issue) PermaLink() string {
 	return p.issue.WebURL
 }
 
+// State returns the state of the issue. GitLab calls open issues "opened".
+func (p *Issue) State() string {
+	if p.issue.State == "opened" {
+		return fs.StateOpen
+	}
+	return p.issue.State
+}
+
+func (p *Issue) Labels() []string {
+	return p.issue.Labels
+}
+
+func (p *Issue) Assignees() []string {
+	a := make([]string, len(p.issue.Assignees))
+	for i, u := range p.issue.Assignees {
+		a[i] = u.Username
+	}
+	return a
+}
+
+func (p *Issue) Author() string {
+	if p.issue.Author == nil {
+		return ""
+	}
+	return p.issue.Author.Username
+}
+
+func (p *Issue) Milestone() string {
+	if p.issue.Milestone == nil {
+		return ""
+	}
+	return p.issue.Milestone.Title
+}
+
+func (p *Issue) Due() time.Time {
+	if p.issue.DueDate == nil {
+		return time.Time{}
+	}
+	return time.Time(*p.issue.DueDate)
+}
+
 func (p *Issue) Creation() time.Time {
 	return *p.issue.CreatedAt
 }
@@ -83,27 +139,168 @@ func (p *Issue) Comments() (a []fs.Comment, err error) {
 	return a, nil
 }
 
+func (p *Issue) AddComment(body string) error {
+	pid := p.issue.ProjectID
+	n := p.issue.IID
+	opt := &gitlab.CreateIssueNoteOptions{
+		Body: gitlab.Ptr(body),
+	}
+	v, _, err := p.svc.c.Notes.CreateIssueNote(pid, n, opt)
+	if err != nil {
+		return wrapError(err)
+	}
+	// posting a note updates the issue
+	if v.UpdatedAt != nil {
+		issue := *p.issue
+		issue.UpdatedAt = v.UpdatedAt
+		p.issue = &issue
+	}
+	return nil
+}
+
+func (p *Issue) Latest() (time.Time, error) {
+	v, _, err := p.svc.c.Issues.GetIssue(p.issue.ProjectID, p.issue.IID)
+	if err != nil {
+		return time.Time{}, wrapError(err)
+	}
+	return *v.UpdatedAt, nil
+}
+
+func (p *Issue) SetSubject(s string) error {
+	return p.update(&gitlab.UpdateIssueOptions{Title: gitlab.Ptr(s)})
+}
+
+func (p *Issue) SetMessage(s string) error {
+	return p.update(&gitlab.UpdateIssueOptions{Description: gitlab.Ptr(s)})
+}
+
+func (p *Issue) AddLabels(a []string) error {
+	labels := gitlab.LabelOptions(a)
+	return p.update(&gitlab.UpdateIssueOptions{AddLabels: &labels})
+}
+
+func (p *Issue) RemoveLabels(a []string) error {
+	labels := gitlab.LabelOptions(a)
+	return p.update(&gitlab.UpdateIssueOptions{RemoveLabels: &labels})
+}
+
+func (p *Issue) AddAssignees(a []string) error {
+	ids := p.assigneeIDs(nil)
+	for _, name := range a {
+		id, err := p.svc.userID(name)
+		if err != nil {
+			return err
+		}
+		ids = append(ids, id)
+	}
+	return p.update(&gitlab.UpdateIssueOptions{AssigneeIDs: &ids})
+}
+
+func (p *Issue) RemoveAssignees(a []string) error {
+	ids := p.assigneeIDs(a)
+	return p.update(&gitlab.UpdateIssueOptions{AssigneeIDs: &ids})
+}
+
+// assigneeIDs returns IDs of current assignees except for users in excludes.
+func (p *Issue) assigneeIDs(excludes []string) []int {
+	ids := make([]int, 0, len(p.issue.Assignees))
+L:
+	for _, u := range p.issue.Assignees {
+		for _, name := range excludes {
+			if u.Username == name {
+				continue L
+			}
+		}
+		ids = append(ids, u.ID)
+	}
+	return ids
+}
+
+func (p *Issue) SetState(state string) error {
+	var event string
+	switch state {
+	case fs.StateOpen:
+		event = "reopen"
+	case fs.StateClosed:
+		event = "close"
+	default:
+		return errUnknownState
+	}
+	return p.update(&gitlab.UpdateIssueOptions{StateEvent: gitlab.Ptr(event)})
+}
+
+func (p *Issue) update(opt *gitlab.UpdateIssueOptions) error {
+	v, _, err := p.svc.c.Issues.UpdateIssue(p.issue.ProjectID, p.issue.IID, opt)
+	if err != nil {
+		return wrapError(err)
+	}
+	p.issue = v
+	return nil
+}
+
 func (p *Issue) fetchNotes(page int) ([]*gitlab.Note, int, error) {
 	pid := p.issue.ProjectID
-	n := p.issue.ID
+	n := p.issue.IID
 	var opt gitlab.ListIssueNotesOptions
 	opt.Page = page
 	b, resp, err := p.svc.c.Notes.ListIssueNotes(pid, n, &opt)
 	if err != nil {
-		return nil, 0, err
+		return nil, 0, wrapError(err)
 	}
 	return b, resp.NextPage, nil
 }
 
+// wrapError wraps err returned from the API with fs.HTTPError.
+func wrapError(err error) error {
+	var e *gitlab.ErrorResponse
+	var xerr *ratelimit.ExceededError
+	switch {
+	case errors.As(err, &xerr):
+		return &fs.HTTPError{StatusCode: http.StatusTooManyRequests, Err: err}
+	case errors.As(err, &e) && e.Response != nil:
+		return &fs.HTTPError{StatusCode: e.Response.StatusCode, Err: err}
+	}
+	return err
+}
+
 type Config struct {
 	BaseURL string
 	Token   string
+	Filter  *fs.Filter // optional
 }
 
 type Service struct {
-	c        *gitlab.Client
-	name     string
+	c      *gitlab.Client
+	t      *ratelimit.Transport
+	name   string
+	filter fs.Filter
+
+	mu       sync.Mutex
 	projects map[int]*gitlab.Project
+
+	listMu sync.Mutex // protects below
+	issues map[int]*gitlab.Issue
+	since  time.Time // last update time of issues
+}
+
+var (
+	errMissingRepo  = errors.New("repo is missing")
+	errUnknownState = errors.New("unknown state")
+
+	errUnsupportedFilter = errors.New("gitlab doesn't support filter=mentioned")
+)
+
+// scopes maps filters to scopes of GitLab API.
+var scopes = map[string]string{
+	"assigned": "assigned_to_me",
+	"created":  "created_by_me",
+	"all":      "all",
+}
+
+// states maps filters to states of GitLab API.
+var states = map[string]string{
+	fs.StateOpen:   "opened",
+	fs.StateClosed: "closed",
 }
 
 func NewService(config *Config) (*Service, error) {
@@ -111,34 +308,170 @@ func NewService(config *Config) (*Service, error) {
 	if err != nil {
 		return nil, err
 	}
-	c, err := gitlab.NewClient(config.Token, gitlab.WithBaseURL(config.BaseURL))
+	// retries are done by ratelimit.Transport
+	t := ratelimit.NewTransport(nil)
+	c, err := gitlab.NewClient(config.Token,
+		gitlab.WithBaseURL(config.BaseURL),
+		gitlab.WithHTTPClient(&http.Client{Transport: httpcache.NewTransport(t)}),
+		gitlab.WithoutRetries(),
+	)
 	if err != nil {
 		return nil, err
 	}
 	svc := &Service{
 		c:        c,
+		t:        t,
 		name:     u.Host,
 		projects: make(map[int]*gitlab.Project),
 	}
+	if config.Filter != nil {
+		svc.filter = *config.Filter
+	}
+	if svc.filter.Filter == "mentioned" {
+		return nil, errUnsupportedFilter
+	}
 	return svc, nil
 }
 
+// Name returns the host name of the service. If the service is limited
+// to a project, its path or ID is appended to the host such as
+// host/group/project.
 func (p *Service) Name() string {
+	if p.filter.Project != "" {
+		return p.name + "/" + p.filter.Project
+	}
 	return p.name
 }
 
+func (p *Service) RateLimit() []fs.RateLimit {
+	quotas := p.t.RateLimit()
+	a := make([]fs.RateLimit, len(quotas))
+	for i, q := range quotas {
+		a[i] = fs.RateLimit{
+			Resource:  q.Resource,
+			Limit:     q.Limit,
+			Remaining: q.Remaining,
+			Reset:     q.Reset,
+		}
+	}
+	return a
+}
+
+// List returns issues selected by the filter. After the first call,
+// it fetches only issues updated since the last call and merges them.
 func (p *Service) List() ([]fs.Task, error) {
-	var a []fs.Task
+	p.listMu.Lock()
+	defer p.listMu.Unlock()
+	state := states[p.filter.State]
+	since := p.filter.Since
+	if !p.since.IsZero() {
+		// issues that changed the state are needed to remove them
+		state = ""
+		since = p.since
+	}
+	var a []*gitlab.Issue
+	var err error
+	if p.filter.Project != "" {
+		a, err = p.listProject(state, since)
+	} else {
+		a, err = p.list(state, since)
+	}
+	if err != nil {
+		return nil, err
+	}
+	issues := p.issues
+	if p.since.IsZero() {
+		issues = make(map[int]*gitlab.Issue)
+	}
+	last := p.since
+	for _, v := range a {
+		if p.match(v) {
+			issues[v.ID] = v
+		} else {
+			delete(issues, v.ID)
+		}
+		if t := v.UpdatedAt; t != nil && t.After(last) {
+			last = *t
+		}
+	}
+	b := make([]*gitlab.Issue, 0, len(issues))
+	for _, v := range issues {
+		b = append(b, v)
+	}
+	sort.Slice(b, func(i, j int) bool {
+		return b[i].CreatedAt.After(*b[j].CreatedAt)
+	})
+	tasks, err := p.convertAppendIssues(nil, b)
+	if err != nil {
+		return nil, err
+	}
+	p.issues = issues
+	p.since = last
+	return tasks, nil
+}
+
+// match reports whether the state of v matches the filter.
+func (p *Service) match(v *gitlab.Issue) bool {
+	state, ok := states[p.filter.State]
+	return !ok || v.State == state
+}
+
+// list returns issues selected by the filter; by default, issues
+// created by the user.
+func (p *Service) list(state string, since time.Time) ([]*gitlab.Issue, error) {
 	var opt gitlab.ListIssuesOptions
+	if scope, ok := scopes[p.filter.Filter]; ok {
+		opt.Scope = gitlab.Ptr(scope)
+	}
+	if state != "" {
+		opt.State = gitlab.Ptr(state)
+	}
+	if len(p.filter.Labels) > 0 {
+		labels := gitlab.LabelOptions(p.filter.Labels)
+		opt.Labels = &labels
+	}
+	if !since.IsZero() {
+		opt.UpdatedAfter = gitlab.Ptr(since)
+	}
+	var a []*gitlab.Issue
 	for {
 		b, resp, err := p.c.Issues.ListIssues(&opt)
 		if err != nil {
-			return nil, err
+			return nil, wrapError(err)
 		}
-		a, err = p.convertAppendIssues(a, b)
+		a = append(a, b...)
+		if resp.NextPage == 0 {
+			break
+		}
+		opt.Page = resp.NextPage
+	}
+	return a, nil
+}
+
+// listProject returns issues of the project specified by the project
+// filter. Unlike list, it returns issues of all users by default.
+func (p *Service) listProject(state string, since time.Time) ([]*gitlab.Issue, error) {
+	var opt gitlab.ListProjectIssuesOptions
+	if scope, ok := scopes[p.filter.Filter]; ok {
+		opt.Scope = gitlab.Ptr(scope)
+	}
+	if state != "" {
+		opt.State = gitlab.Ptr(state)
+	}
+	if len(p.filter.Labels) > 0 {
+		labels := gitlab.LabelOptions(p.filter.Labels)
+		opt.Labels = &labels
+	}
+	if !since.IsZero() {
+		opt.UpdatedAfter = gitlab.Ptr(since)
+	}
+	var a []*gitlab.Issue
+	for {
+		b, resp, err := p.c.Issues.ListProjectIssues(p.filter.Project, &opt)
 		if err != nil {
-			return nil, err
+			return nil, wrapError(err)
 		}
+		a = append(a, b...)
 		if resp.NextPage == 0 {
 			break
 		}
@@ -147,6 +480,63 @@ func (p *Service) List() ([]fs.Task, error) {
 	return a, nil
 }
 
+// Search returns issues found by expr with GitLab search API.
+// The search is limited to the project if the service has it.
+func (p *Service) Search(expr string) ([]fs.Task, error) {
+	opt := gitlab.SearchOptions{
+		ListOptions: gitlab.ListOptions{PerPage: 100},
+	}
+	var a []*gitlab.Issue
+	for {
+		var b []*gitlab.Issue
+		var resp *gitlab.Response
+		var err error
+		if p.filter.Project != "" {
+			b, resp, err = p.c.Search.IssuesByProject(p.filter.Project, expr, &opt)
+		} else {
+			b, resp, err = p.c.Search.Issues(expr, &opt)
+		}
+		if err != nil {
+			return nil, wrapError(err)
+		}
+		a = append(a, b...)
+		if resp.NextPage == 0 {
+			break
+		}
+		opt.Page = resp.NextPage
+	}
+	return p.convertAppendIssues(nil, a)
+}
+
+// Invalidate makes next List fetch all issues.
+func (p *Service) Invalidate() {
+	p.listMu.Lock()
+	defer p.listMu.Unlock()
+	p.since = time.Time{}
+}
+
+// Create creates an issue into the project specified by params["repo"].
+// It is either a project ID or a path such as "group/name". The project
+// of the service is used if it is omitted.
+func (p *Service) Create(params map[string]string, subject, message string) (fs.Task, error) {
+	pid := params["repo"]
+	if pid == "" {
+		pid = p.filter.Project
+	}
+	if pid == "" {
+		return nil, errMissingRepo
+	}
+	opt := &gitlab.CreateIssueOptions{
+		Title:       gitlab.Ptr(subject),
+		Description: gitlab.Ptr(message),
+	}
+	v, _, err := p.c.Issues.CreateIssue(pid, opt)
+	if err != nil {
+		return nil, wrapError(err)
+	}
+	return p.fetchTask(v)
+}
+
 func (p *Service) convertAppendIssues(a []fs.Task, b []*gitlab.Issue) ([]fs.Task, error) {
 	for _, v := range b {
 		task, err := p.fetchTask(v)
@@ -158,14 +548,32 @@ func (p *Service) convertAppendIssues(a []fs.Task, b []*gitlab.Issue) ([]fs.Task
 	return a, nil
 }
 
+func (p *Service) userID(name string) (int, error) {
+	opt := &gitlab.ListUsersOptions{
+		Username: gitlab.Ptr(name),
+	}
+	users, _, err := p.c.Users.ListUsers(opt)
+	if err != nil {
+		return 0, wrapError(err)
+	}
+	if len(users) == 0 {
+		return 0, errors.New("unknown user: " + name)
+	}
+	return users[0].ID, nil
+}
+
 func (p *Service) fetchTask(v *gitlab.Issue) (task fs.Task, err error) {
+	p.mu.Lock()
 	proj := p.projects[v.ProjectID]
+	p.mu.Unlock()
 	if proj == nil {
 		proj, _, err = p.c.Projects.GetProject(v.ProjectID, nil)
 		if err != nil {
-			return
+			return nil, wrapError(err)
 		}
+		p.mu.Lock()
 		p.projects[v.ProjectID] = proj
+		p.mu.Unlock()
 	}
 	return &Issue{issue: v, proj: proj, svc: p}, nil
 }
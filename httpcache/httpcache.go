@@ -0,0 +1,112 @@
+// Package httpcache provides an HTTP transport that revalidates
+// responses with ETag and Last-Modified headers.
+package httpcache
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"sync"
+)
+
+// maxEntries is the number of responses kept by a Transport.
+const maxEntries = 1024
+
+type entry struct {
+	etag    string
+	lastMod string
+	header  http.Header
+	body    []byte
+}
+
+// Transport is a http.RoundTripper that sends conditional requests for
+// GET requests that were responded before. If the server responds 304
+// Not Modified, Transport returns the stored response as 200 OK.
+type Transport struct {
+	Base http.RoundTripper
+
+	mu      sync.Mutex // protects below
+	entries map[string]*entry
+}
+
+// NewTransport returns a Transport that sends requests with base.
+// If base is nil, http.DefaultTransport is used.
+func NewTransport(base http.RoundTripper) *Transport {
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	return &Transport{
+		Base:    base,
+		entries: make(map[string]*entry),
+	}
+}
+
+func (t *Transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Method != http.MethodGet {
+		return t.Base.RoundTrip(req)
+	}
+	key := req.URL.String()
+	t.mu.Lock()
+	e := t.entries[key]
+	t.mu.Unlock()
+	if e != nil {
+		// RoundTrip must not modify the request.
+		req = req.Clone(req.Context())
+		if e.etag != "" {
+			req.Header.Set("If-None-Match", e.etag)
+		}
+		if e.lastMod != "" {
+			req.Header.Set("If-Modified-Since", e.lastMod)
+		}
+	}
+	resp, err := t.Base.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case resp.StatusCode == http.StatusNotModified && e != nil:
+		resp.Body.Close()
+		h := e.header.Clone()
+		for k, v := range resp.Header {
+			h[k] = v
+		}
+		resp.StatusCode = http.StatusOK
+		resp.Status = "200 OK"
+		resp.Header = h
+		resp.Body = io.NopCloser(bytes.NewReader(e.body))
+		resp.ContentLength = int64(len(e.body))
+		return resp, nil
+	case resp.StatusCode == http.StatusOK:
+		etag := resp.Header.Get("ETag")
+		lastMod := resp.Header.Get("Last-Modified")
+		if etag == "" && lastMod == "" {
+			return resp, nil
+		}
+		body, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		resp.Body = io.NopCloser(bytes.NewReader(body))
+		t.store(key, &entry{
+			etag:    etag,
+			lastMod: lastMod,
+			header:  resp.Header.Clone(),
+			body:    body,
+		})
+	}
+	return resp, nil
+}
+
+func (t *Transport) store(key string, e *entry) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if _, ok := t.entries[key]; !ok && len(t.entries) >= maxEntries {
+		// evict an arbitrary entry
+		for k := range t.entries {
+			delete(t.entries, k)
+			break
+		}
+	}
+	t.entries[key] = e
+}
@@ -0,0 +1,91 @@
+package httpcache
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestRevalidate(t *testing.T) {
+	var conds []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conds = append(conds, r.Header.Get("If-None-Match"))
+		if r.Header.Get("If-None-Match") == `"v1"` {
+			w.Header().Set("X-RateLimit-Remaining", "4998")
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Header().Set("ETag", `"v1"`)
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("X-RateLimit-Remaining", "4999")
+		fmt.Fprint(w, `{"id":1}`)
+	}))
+	defer srv.Close()
+
+	tr := NewTransport(nil)
+	get := func() *http.Response {
+		t.Helper()
+		req, err := http.NewRequest(http.MethodGet, srv.URL+"/issues", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, err := tr.RoundTrip(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(req.Header) != 0 {
+			t.Errorf("RoundTrip modified the request header: %v", req.Header)
+		}
+		return resp
+	}
+	readBody := func(resp *http.Response) string {
+		t.Helper()
+		defer resp.Body.Close()
+		p, err := io.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(p)
+	}
+	if s := readBody(get()); s != `{"id":1}` {
+		t.Errorf("first body = %q; want %q", s, `{"id":1}`)
+	}
+
+	resp := get()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("StatusCode = %d; want %d", resp.StatusCode, http.StatusOK)
+	}
+	if s := resp.Header.Get("Content-Type"); s != "application/json" {
+		t.Errorf("Content-Type = %q; want the stored header", s)
+	}
+	if s := resp.Header.Get("X-RateLimit-Remaining"); s != "4998" {
+		t.Errorf("X-RateLimit-Remaining = %q; want the header of 304 response", s)
+	}
+	if s := readBody(resp); s != `{"id":1}` {
+		t.Errorf("second body = %q; want the stored body", s)
+	}
+	if len(conds) != 2 || conds[0] != "" || conds[1] != `"v1"` {
+		t.Errorf("If-None-Match = %q; want none then the ETag", conds)
+	}
+}
+
+func TestEvict(t *testing.T) {
+	tr := NewTransport(nil)
+	for i := 0; i <= maxEntries; i++ {
+		tr.store(fmt.Sprint(i), &entry{etag: fmt.Sprint(i)})
+	}
+	if n := len(tr.entries); n != maxEntries {
+		t.Errorf("len(entries) = %d; want %d", n, maxEntries)
+	}
+	if tr.entries[fmt.Sprint(maxEntries)] == nil {
+		t.Errorf("the last entry is evicted")
+	}
+
+	// replacing an entry doesn't evict others.
+	tr.store(fmt.Sprint(maxEntries), &entry{etag: "new"})
+	if n := len(tr.entries); n != maxEntries {
+		t.Errorf("len(entries) = %d after replacing; want %d", n, maxEntries)
+	}
+}
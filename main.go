@@ -3,6 +3,9 @@ package main
 import (
 	"flag"
 	"log"
+	"os"
+	"path/filepath"
+	"time"
 
 	"github.com/lufia/taskfs/backlog"
 	"github.com/lufia/taskfs/fs"
@@ -11,7 +14,11 @@ import (
 )
 
 var (
-	debug = flag.Bool("d", false, "turn on debug print")
+	debug        = flag.Bool("d", false, "turn on debug print")
+	config       = flag.String("c", "", "load services from `file`")
+	cacheDir     = flag.String("cache", defaultCacheDir(), "store fetched tasks into `dir`; empty disables it")
+	attrTimeout  = flag.Duration("attr-timeout", time.Minute, "kernel cache `duration` of attributes")
+	entryTimeout = flag.Duration("entry-timeout", time.Minute, "kernel cache `duration` of directory entries")
 
 	mtpt = "/mnt/taskfs"
 )
@@ -19,28 +26,50 @@ var (
 func main() {
 	flag.Parse()
 	root := fs.NewRoot()
-	root.RegisterService("github", func(token, url string) (fs.Service, error) {
+	root.SetCacheDir(*cacheDir)
+	root.RegisterService("github", func(token, url string, filter *fs.Filter) (fs.Service, error) {
 		return github.NewService(&github.Config{
 			BaseURL: url,
 			Token:   token,
+			Filter:  filter,
 		})
 	})
-	root.RegisterService("gitlab", func(token, url string) (fs.Service, error) {
+	root.RegisterService("gitlab", func(token, url string, filter *fs.Filter) (fs.Service, error) {
 		return gitlab.NewService(&gitlab.Config{
 			BaseURL: url,
 			Token:   token,
+			Filter:  filter,
 		})
 	})
-	root.RegisterService("backlog", func(token, url string) (fs.Service, error) {
+	root.RegisterService("backlog", func(token, url string, filter *fs.Filter) (fs.Service, error) {
 		return backlog.NewService(&backlog.Config{
 			BaseURL: url,
 			APIKey:  token,
+			Filter:  filter,
 		})
 	})
+	if *config != "" {
+		if err := root.LoadConfig(*config); err != nil {
+			log.Fatal(err)
+		}
+	}
 	if flag.NArg() > 0 {
 		mtpt = flag.Arg(0)
 	}
-	if err := root.MountAndServe(mtpt, *debug); err != nil {
+	opts := fs.MountOptions{
+		Debug:        *debug,
+		AttrTimeout:  *attrTimeout,
+		EntryTimeout: *entryTimeout,
+	}
+	if err := root.MountAndServe(mtpt, &opts); err != nil {
 		log.Fatal(err)
 	}
 }
+
+func defaultCacheDir() string {
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(dir, "taskfs")
+}
@@ -0,0 +1,295 @@
+// Package ratelimit provides an HTTP transport that follows rate limits
+// reported by APIs such as GitHub and GitLab.
+package ratelimit
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	maxRetries    = 3
+	maxWait       = time.Minute // requests waiting longer than this fail
+	maxConcurrent = 4
+	initialDelay  = time.Second
+)
+
+// Transport is a http.RoundTripper shared by all requests to a service.
+// It limits concurrent requests, waits until the quota is reset if it
+// was exhausted, and retries requests rejected by rate limits.
+//
+// Services such as GitHub have separate quotas for resources, such as
+// core and search. A quota is recorded for the resource named by
+// X-RateLimit-Resource header of the response, or Resource if the header
+// is missing; requests wait only for the quota of their own resource.
+type Transport struct {
+	Base http.RoundTripper
+
+	// Resource returns the name of the resource that req uses.
+	// If it is nil, all requests use the same quota.
+	Resource func(req *http.Request) string
+
+	sem chan struct{}
+
+	mu     sync.Mutex        // protects below
+	quotas map[string]*quota // by resource
+}
+
+// quota is the rate limit of a resource.
+type quota struct {
+	limit     int
+	remaining int // negative if unknown
+	reset     time.Time
+	until     time.Time // requests are suspended until
+}
+
+// NewTransport returns a Transport that sends requests with base.
+// If base is nil, http.DefaultTransport is used.
+func NewTransport(base http.RoundTripper) *Transport {
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	return &Transport{
+		Base:   base,
+		sem:    make(chan struct{}, maxConcurrent),
+		quotas: make(map[string]*quota),
+	}
+}
+
+// Quota is the rate limit of a resource reported by the service.
+type Quota struct {
+	Resource  string // empty if the service doesn't tell it
+	Limit     int
+	Remaining int
+	Reset     time.Time
+}
+
+// ExceededError is returned by RoundTrip if the quota of the resource
+// was exhausted and it won't be reset soon.
+type ExceededError struct {
+	Resource string
+	Reset    time.Time
+}
+
+func (e *ExceededError) Error() string {
+	return fmt.Sprintf("rate limit exceeded; reset at %s", e.Reset.Format(time.RFC3339))
+}
+
+// RateLimit returns the quotas reported by the last responses of each
+// resource, ordered by their names.
+func (t *Transport) RateLimit() []Quota {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	var a []Quota
+	for name, q := range t.quotas {
+		if q.remaining < 0 {
+			continue
+		}
+		a = append(a, Quota{
+			Resource:  name,
+			Limit:     q.limit,
+			Remaining: q.remaining,
+			Reset:     q.reset,
+		})
+	}
+	sort.Slice(a, func(i, j int) bool {
+		return a[i].Resource < a[j].Resource
+	})
+	return a
+}
+
+// resource returns the name of the resource that req uses.
+func (t *Transport) resource(req *http.Request) string {
+	if t.Resource == nil {
+		return ""
+	}
+	return t.Resource(req)
+}
+
+// quota returns the quota of the resource name.
+// It must be called while holding t.mu.
+func (t *Transport) quota(name string) *quota {
+	q := t.quotas[name]
+	if q == nil {
+		q = &quota{remaining: -1}
+		t.quotas[name] = q
+	}
+	return q
+}
+
+func (t *Transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	delay := initialDelay
+	for i := 0; ; i++ {
+		r := req
+		if i > 0 {
+			// RoundTrip must not modify the request.
+			var err error
+			r, err = rewind(req)
+			if err != nil {
+				return nil, err
+			}
+		}
+		if err := t.wait(r); err != nil {
+			return nil, err
+		}
+		resp, err := t.do(r)
+		if err != nil {
+			return nil, err
+		}
+		name, d, limited := t.update(r, resp)
+		if !limited || i >= maxRetries {
+			return resp, nil
+		}
+		if d <= 0 {
+			d = delay
+			delay *= 2
+		}
+		if d > maxWait {
+			return resp, nil
+		}
+		resp.Body.Close()
+		t.suspend(name, d)
+	}
+}
+
+// rewind returns a copy of req to send it again.
+func rewind(req *http.Request) (*http.Request, error) {
+	r := req.Clone(req.Context())
+	if req.Body == nil || req.Body == http.NoBody {
+		return r, nil
+	}
+	if req.GetBody == nil {
+		return nil, errors.New("ratelimit: cannot rewind the request body")
+	}
+	body, err := req.GetBody()
+	if err != nil {
+		return nil, err
+	}
+	r.Body = body
+	return r, nil
+}
+
+func (t *Transport) do(req *http.Request) (*http.Response, error) {
+	select {
+	case t.sem <- struct{}{}:
+	case <-req.Context().Done():
+		return nil, req.Context().Err()
+	}
+	defer func() {
+		<-t.sem
+	}()
+	return t.Base.RoundTrip(req)
+}
+
+// wait blocks while requests to the resource of req are suspended.
+func (t *Transport) wait(req *http.Request) error {
+	name := t.resource(req)
+	t.mu.Lock()
+	q := t.quota(name)
+	until := q.until
+	if q.remaining == 0 && q.reset.After(until) {
+		until = q.reset
+	}
+	t.mu.Unlock()
+	d := time.Until(until)
+	if d <= 0 {
+		return nil
+	}
+	if d > maxWait {
+		return &ExceededError{Resource: name, Reset: until}
+	}
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-req.Context().Done():
+		return req.Context().Err()
+	}
+}
+
+// suspend suspends requests to the resource name for d.
+func (t *Transport) suspend(name string, d time.Duration) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	q := t.quota(name)
+	if until := time.Now().Add(d); until.After(q.until) {
+		q.until = until
+	}
+}
+
+// update records the quota reported by resp to req. It returns the name
+// of the resource, and reports whether resp is rejected by rate limits
+// with the duration to wait before retry if the service tells it.
+func (t *Transport) update(req *http.Request, resp *http.Response) (string, time.Duration, bool) {
+	h := resp.Header
+	name := h.Get("X-RateLimit-Resource")
+	if name == "" {
+		name = t.resource(req)
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	q := t.quota(name)
+	if n, ok := header(h, "X-RateLimit-Limit", "RateLimit-Limit"); ok {
+		q.limit = n
+	}
+	if n, ok := header(h, "X-RateLimit-Remaining", "RateLimit-Remaining"); ok {
+		q.remaining = n
+	}
+	if n, ok := header(h, "X-RateLimit-Reset", "RateLimit-Reset"); ok {
+		q.reset = time.Unix(int64(n), 0)
+	}
+	d, hasRetryAfter := retryAfter(h)
+	switch resp.StatusCode {
+	case http.StatusTooManyRequests:
+	case http.StatusForbidden:
+		// GitHub responds 403 for both primary and secondary rate limits.
+		if !hasRetryAfter && q.remaining != 0 {
+			return name, 0, false
+		}
+	default:
+		return name, 0, false
+	}
+	if d == 0 && q.remaining == 0 {
+		d = time.Until(q.reset)
+	}
+	return name, d, true
+}
+
+// retryAfter returns the duration specified by Retry-After header.
+// Its value is either seconds or an HTTP-date.
+func retryAfter(h http.Header) (time.Duration, bool) {
+	s := h.Get("Retry-After")
+	if s == "" {
+		return 0, false
+	}
+	if n, err := strconv.Atoi(s); err == nil {
+		return time.Duration(n) * time.Second, true
+	}
+	t, err := http.ParseTime(s)
+	if err != nil {
+		return 0, false
+	}
+	return time.Until(t), true
+}
+
+// header returns the integer value of the first header found in names.
+func header(h http.Header, names ...string) (int, bool) {
+	for _, name := range names {
+		s := h.Get(name)
+		if s == "" {
+			continue
+		}
+		n, err := strconv.Atoi(s)
+		if err != nil {
+			return 0, false
+		}
+		return n, true
+	}
+	return 0, false
+}
@@ -0,0 +1,135 @@
+package ratelimit
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRetryAfter(t *testing.T) {
+	tests := []struct {
+		s    string
+		min  time.Duration
+		max  time.Duration
+		want bool
+	}{
+		{s: "", want: false},
+		{s: "3", min: 3 * time.Second, max: 3 * time.Second, want: true},
+		{s: time.Now().Add(time.Minute).UTC().Format(http.TimeFormat), min: 58 * time.Second, max: time.Minute, want: true},
+		{s: "soon", want: false},
+	}
+	for _, tt := range tests {
+		h := make(http.Header)
+		if tt.s != "" {
+			h.Set("Retry-After", tt.s)
+		}
+		d, ok := retryAfter(h)
+		if ok != tt.want {
+			t.Errorf("retryAfter(%q) = _, %t; want %t", tt.s, ok, tt.want)
+			continue
+		}
+		if d < tt.min || d > tt.max {
+			t.Errorf("retryAfter(%q) = %v; want in [%v, %v]", tt.s, d, tt.min, tt.max)
+		}
+	}
+}
+
+func TestRoundTripRetry(t *testing.T) {
+	var bodies []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		p, _ := io.ReadAll(r.Body)
+		bodies = append(bodies, string(p))
+		if len(bodies) == 1 {
+			w.Header().Set("Retry-After", "1")
+			w.WriteHeader(http.StatusTooManyRequests)
+			return
+		}
+		w.WriteHeader(http.StatusCreated)
+	}))
+	defer srv.Close()
+
+	req, err := http.NewRequest(http.MethodPost, srv.URL, strings.NewReader("body"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	body := req.Body
+	resp, err := NewTransport(nil).RoundTrip(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusCreated {
+		t.Errorf("StatusCode = %d; want %d", resp.StatusCode, http.StatusCreated)
+	}
+	if len(bodies) != 2 || bodies[0] != "body" || bodies[1] != "body" {
+		t.Errorf("bodies = %q; want the body twice", bodies)
+	}
+	if req.Body != body {
+		t.Errorf("RoundTrip modified the request body")
+	}
+}
+
+func TestResourceQuota(t *testing.T) {
+	reset := time.Now().Add(time.Hour).Unix()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		h := w.Header()
+		h.Set("X-RateLimit-Reset", strconv.FormatInt(reset, 10))
+		if strings.HasPrefix(r.URL.Path, "/search/") {
+			h.Set("X-RateLimit-Resource", "search")
+			h.Set("X-RateLimit-Limit", "30")
+			h.Set("X-RateLimit-Remaining", "0")
+		} else {
+			h.Set("X-RateLimit-Resource", "core")
+			h.Set("X-RateLimit-Limit", "5000")
+			h.Set("X-RateLimit-Remaining", "4999")
+		}
+	}))
+	defer srv.Close()
+
+	tr := NewTransport(nil)
+	tr.Resource = func(req *http.Request) string {
+		if strings.HasPrefix(req.URL.Path, "/search/") {
+			return "search"
+		}
+		return "core"
+	}
+	get := func(path string) error {
+		req, err := http.NewRequest(http.MethodGet, srv.URL+path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, err := tr.RoundTrip(req)
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+		return nil
+	}
+	if err := get("/search/issues"); err != nil {
+		t.Fatal(err)
+	}
+	// the search quota is exhausted until the reset, an hour later.
+	if err := get("/repos/lufia/taskfs/issues"); err != nil {
+		t.Errorf("core request: %v", err)
+	}
+	var xerr *ExceededError
+	if err := get("/search/issues"); !errors.As(err, &xerr) || xerr.Resource != "search" {
+		t.Errorf("search request: %v; want ExceededError of search", err)
+	}
+
+	a := tr.RateLimit()
+	if len(a) != 2 {
+		t.Fatalf("RateLimit = %v; want 2 quotas", a)
+	}
+	if a[0].Resource != "core" || a[0].Remaining != 4999 {
+		t.Errorf("RateLimit[0] = %+v; want core with 4999 remaining", a[0])
+	}
+	if a[1].Resource != "search" || a[1].Remaining != 0 {
+		t.Errorf("RateLimit[1] = %+v; want search with 0 remaining", a[1])
+	}
+}